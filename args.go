@@ -0,0 +1,48 @@
+package twist
+
+// The argument stack is a queue, in spite of its name: ADDARG puts a value at the back, and everything
+// that takes arguments (CALL, SPAWN, GEN, a host function, ADD % and the rest) takes them from the front,
+// so a function's arguments arrive in the order they were added, and the results it ADDARGs before RET queue up behind anything still waiting.
+// CMP % only reads the front value and leaves it there.
+// POPARG, PEEKARG and DUPARG work on that front value too, CLEARARGS empties the queue and ARGC counts what's waiting
+
+// frontArg is the value the next instruction taking arguments would get, ok is false once NOT_ENOUGH_ARGS_ERROR has been thrown
+func (vm *VM) frontArg(inst *Instruction) (value Value, ok bool) {
+	if len(vm.args) == 0 {
+		vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+		return Value{}, false
+	}
+	return vm.args[0], true
+}
+
+func (vm *VM) opPOPARG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if value, ok := vm.frontArg(inst); ok {
+		vm.args = vm.args[1:]
+		currentVWheel.data = append(currentVWheel.data, value)
+	}
+	return Next
+}
+
+func (vm *VM) opPEEKARG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if value, ok := vm.frontArg(inst); ok {
+		currentVWheel.data = append(currentVWheel.data, value)
+	}
+	return Next
+}
+
+func (vm *VM) opDUPARG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if value, ok := vm.frontArg(inst); ok {
+		vm.args = append([]Value{value}, vm.args...)
+	}
+	return Next
+}
+
+func (vm *VM) opCLEARARGS(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.args = nil
+	return Next
+}
+
+func (vm *VM) opARGC(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	currentVWheel.data = append(currentVWheel.data, IntValue(len(vm.args)))
+	return Next
+}
@@ -0,0 +1,75 @@
+package twist
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchmarkProgram runs a program from start to end b.N times, loading it once.
+// DEL doesn't sleep, INP reads input and everything printed is thrown away.
+// A program that stops with a runtime error, like advanced_for does, still counts as a run
+func benchmarkProgram(b *testing.B, instructions []Instruction, input string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vm := NewVM(instructions)
+		vm.clock = NewSkipClock()
+		vm.stdin = bufio.NewReader(strings.NewReader(input))
+		vm.stdout = io.Discard
+		vm.stderr = io.Discard
+		runToEnd(vm)
+	}
+}
+
+func runToEnd(vm *VM) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*RuntimeError); !ok {
+				panic(r)
+			}
+		}
+	}()
+	vm.Run()
+}
+
+// BenchmarkPrograms runs every example in programs/, answering INP with the same numbers and operator
+func BenchmarkPrograms(b *testing.B) {
+	paths, err := filepath.Glob("programs/*.whl")
+	if err != nil || len(paths) == 0 {
+		b.Fatalf("no example programs: %v", err)
+	}
+	for _, path := range paths {
+		instructions, err := LoadProgram(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(strings.TrimSuffix(filepath.Base(path), ".whl"), func(b *testing.B) {
+			benchmarkProgram(b, instructions, "6\n7\n*\n")
+		})
+	}
+}
+
+// BenchmarkLoop is a long running tail recursive loop, where the time goes on dispatching instructions rather than setting up the VM
+func BenchmarkLoop(b *testing.B) {
+	const source = `DEF "down" 1
+CMP 0
+JIZ -5
+ADD -1
+ADDARG
+CALL "down" 1
+OUT "never"
+RET
+NEWV 10000
+ADDARG
+CALL "down" 1
+OUT "skipped"
+OUT "done"
+`
+	instructions, err := NewLoader().LoadSource("", source)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkProgram(b, instructions, "")
+}
@@ -0,0 +1,158 @@
+package twist
+
+import "fmt"
+
+const (
+	SeverityError   = 1
+	SeverityWarning = 2
+)
+
+type Diagnostic struct {
+	Line     int
+	Severity int
+	Message  string
+	// File is the module the diagnostic is in, empty for the program itself
+	File string
+}
+
+// collectFunctions finds every DEF the same way VM.Run does before executing
+func collectFunctions(instructions []Instruction) map[string]function {
+	functions := make(map[string]function)
+	for i, inst := range instructions {
+		if inst.Mnemonic == "DEF" {
+			functions[inst.ArgumentStr] = function{
+				line:           i + 1,
+				argument_count: inst.Argument,
+			}
+		}
+	}
+	return functions
+}
+
+// functionMembership returns, for every instruction, the DEF it belongs to ("" for top level code).
+// A body runs from the DEF up to the first RET after it, which is what the DEF instruction skips over
+func functionMembership(instructions []Instruction) []string {
+	owners := make([]string, len(instructions))
+	current := ""
+	for i, inst := range instructions {
+		if inst.Mnemonic == "DEF" {
+			current = inst.ArgumentStr
+		}
+		owners[i] = current
+		if inst.Mnemonic == "RET" {
+			current = ""
+		}
+	}
+	return owners
+}
+
+// branchTarget is the CWheel index a JMP, JIZ or ERRH at i moves execution to, assuming the
+// CWheel direction set by the closest WHLDIRC above it. An ERRH jumps from the instruction that
+// threw, and the cursor still advances once after the handler, so its target is one further along.
+// A target of len(instructions) means execution falls off the end of the program
+func branchTarget(instructions []Instruction, i int) (int, bool) {
+	inst := instructions[i]
+	n := len(instructions)
+	dir := staticDirection(instructions, i)
+	switch inst.Mnemonic {
+	case "JMP", "JIZ":
+		return jumpTarget(i, inst.Argument, dir, n), true
+	case "ERRH":
+		if i == 0 {
+			return 0, false
+		}
+		return jumpTarget(i-1, inst.Argument, dir, n) + 1, true
+	}
+	return 0, false
+}
+
+// staticDirection guesses the CWheel direction at i from the closest WHLDIRC above it.
+// The VM starts with a direction of 0, which moves like -1
+func staticDirection(instructions []Instruction, i int) int {
+	for j := i - 1; j >= 0; j-- {
+		if instructions[j].Mnemonic == "WHLDIRC" {
+			return instructions[j].Argument
+		}
+	}
+	return 0
+}
+
+// checkProgram looks for mistakes that would otherwise only show up (or panic) at runtime
+func checkProgram(instructions []Instruction) []Diagnostic {
+	var diags []Diagnostic
+	report := func(inst Instruction, severity int, format string, a ...interface{}) {
+		diags = append(diags, Diagnostic{Line: inst.Line, Severity: severity, Message: fmt.Sprintf(format, a...), File: inst.File})
+	}
+
+	functions := collectFunctions(instructions)
+	defined := make(map[string]bool)
+	wheels := make(map[string]bool)
+	for _, inst := range instructions {
+		if inst.Mnemonic == "WHEEL" {
+			wheels[inst.ArgumentStr] = true
+		}
+	}
+
+	for i, inst := range instructions {
+		def, known := lookupMnemonic(inst.Mnemonic)
+		if !known {
+			report(inst, SeverityError, "unknown instruction %s", inst.Mnemonic)
+			continue
+		}
+		// operands the handler doesn't read are ignored at runtime, like they always have been
+		if !def.accepts(shapeOf(inst), true) {
+			report(inst, SeverityWarning, "%s", def.operandError())
+		}
+		switch inst.Mnemonic {
+		case "DEF":
+			if defined[inst.ArgumentStr] {
+				report(inst, SeverityWarning, "function '%s' is defined more than once, the last DEF wins", inst.ArgumentStr)
+			}
+			defined[inst.ArgumentStr] = true
+			terminated := false
+			for j := i + 1; j < len(instructions); j++ {
+				if instructions[j].Mnemonic == "RET" {
+					terminated = true
+					break
+				}
+			}
+			if !terminated {
+				report(inst, SeverityError, "%s: function '%s' has no RET", INCORRECT_TERMINATION_ERROR, inst.ArgumentStr)
+			}
+		case "CALL", "SPAWN", "GEN", "FUNC":
+			if inst.ArgumentStr == "" {
+				// CALL without a name calls a reference, only known at runtime
+				break
+			}
+			fn, found := functions[inst.ArgumentStr]
+			if !found {
+				report(inst, SeverityError, "%s '%s'", UNDEFINED_FUNCTION_ERROR, inst.ArgumentStr)
+			} else if inst.Argument > 0 && fn.argument_count > 0 && inst.Argument != fn.argument_count {
+				// a DEF taking 0 arguments gets however many the CALL passes, like std/wheel
+				report(inst, SeverityWarning, "'%s' takes %d arguments, called with %d", inst.ArgumentStr, fn.argument_count, inst.Argument)
+			}
+		case "USE", "PUT", "GET":
+			if len(inst.ArgumentStr) > 0 && !wheels[inst.ArgumentStr] {
+				report(inst, SeverityError, "%s: no WHEEL \"%s\" in the program", BAD_ARGUMENT_ERROR, inst.ArgumentStr)
+			}
+		case "WHLDIRV", "WHLDIRC":
+			if inst.Argument != 1 && inst.Argument != -1 {
+				report(inst, SeverityError, "%s: direction must be 1 or -1", BAD_ARGUMENT_ERROR)
+			}
+		case "JMP":
+			if inst.Argument == 0 {
+				report(inst, SeverityWarning, "JMP 0 loops forever")
+			}
+		case "ERRH":
+			if len(inst.ArgumentStr) > 0 {
+				if _, found := errorNames[inst.ArgumentStr]; !found {
+					report(inst, SeverityError, "unknown error name '%s'", inst.ArgumentStr)
+				}
+			}
+			if i == 0 {
+				report(inst, SeverityWarning, "ERRH has no instruction before it to handle")
+			}
+		}
+	}
+	return diags
+}
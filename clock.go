@@ -0,0 +1,140 @@
+package twist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock is what DEL sleeps on and TIME reads from. Elapsed is virtual time since the clock was made,
+// which only matches the wall clock for RealClock
+type Clock interface {
+	Sleep(d time.Duration)
+	Elapsed() time.Duration
+}
+
+// RealClock sleeps for real
+type RealClock struct {
+	start time.Time
+}
+
+func NewRealClock() *RealClock {
+	return &RealClock{start: time.Now()}
+}
+
+func (c *RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *RealClock) Elapsed() time.Duration {
+	return time.Since(c.start)
+}
+
+// SkipClock never sleeps, every DEL just moves virtual time forward
+type SkipClock struct {
+	mu      sync.Mutex
+	elapsed time.Duration
+}
+
+func NewSkipClock() *SkipClock {
+	return &SkipClock{}
+}
+
+func (c *SkipClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 {
+		c.elapsed += d
+	}
+}
+
+func (c *SkipClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed
+}
+
+// ScaledClock runs time factor times faster (or slower, below 1), so DEL 1000 at 10x sleeps 100ms
+// and a second of real time reads as ten
+type ScaledClock struct {
+	start  time.Time
+	factor float64
+}
+
+func NewScaledClock(factor float64) *ScaledClock {
+	return &ScaledClock{start: time.Now(), factor: factor}
+}
+
+func (c *ScaledClock) Sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / c.factor))
+}
+
+func (c *ScaledClock) Elapsed() time.Duration {
+	return time.Duration(float64(time.Since(c.start)) * c.factor)
+}
+
+// FakeClock only moves when Advance is called, a Sleep blocks until enough time has been advanced.
+// It's meant for tests that want to control exactly when a DEL finishes
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	elapsed time.Duration
+	waiting int
+}
+
+func NewFakeClock() *FakeClock {
+	c := &FakeClock{}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := c.elapsed + d
+	c.waiting++
+	c.cond.Broadcast()
+	for c.elapsed < deadline {
+		c.cond.Wait()
+	}
+	c.waiting--
+}
+
+func (c *FakeClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed
+}
+
+// Advance moves time forward, waking any Sleep whose deadline has passed
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elapsed += d
+	c.cond.Broadcast()
+}
+
+// BlockUntilSleeping waits for n goroutines to be blocked in Sleep, so a test knows a DEL has started
+func (c *FakeClock) BlockUntilSleeping(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.waiting < n {
+		c.cond.Wait()
+	}
+}
+
+// ParseClock turns a --clock flag into a clock: "real", "skip" or a speed like "10x" or "0.5x"
+func ParseClock(mode string) (Clock, error) {
+	switch mode {
+	case "", "real":
+		return NewRealClock(), nil
+	case "skip":
+		return NewSkipClock(), nil
+	}
+	if factor, err := strconv.ParseFloat(strings.TrimSuffix(mode, "x"), 64); err == nil && strings.HasSuffix(mode, "x") && factor > 0 {
+		return NewScaledClock(factor), nil
+	}
+	return nil, fmt.Errorf("unknown clock %q, use real, skip or a speed like 10x", mode)
+}
@@ -0,0 +1,83 @@
+package twist
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clockProgram builds a VM for source that prints into out and reads time from clock
+func clockProgram(t *testing.T, source string, clock Clock) (vm *VM, out *bytes.Buffer) {
+	t.Helper()
+	vm, out = loadSource(t, source)
+	vm.clock = clock
+	return vm, out
+}
+
+func TestDelWaitsForFakeClock(t *testing.T) {
+	clock := NewFakeClock()
+	vm, out := clockProgram(t, "DEL 500\nTIME\nOUT\n", clock)
+	done := make(chan bool)
+	go func() {
+		vm.Run()
+		close(done)
+	}()
+
+	clock.BlockUntilSleeping(1)
+	clock.Advance(499 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("DEL 500 finished after 499ms")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	<-done
+	if got, want := out.String(), "500 \n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestClockModes(t *testing.T) {
+	const source = `DEL 60000
+NEWV 1000
+ADDARG
+DEL %
+TIME
+MOVVW 1
+OUT
+`
+	clock, err := ParseClock("skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, out := clockProgram(t, source, clock)
+	start := time.Now()
+	vm.Run()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("skip slept, a minute of DEL took %v", took)
+	}
+	if got, want := out.String(), "61000 \n"; got != want {
+		t.Errorf("skip output %q, want %q", got, want)
+	}
+
+	if clock, err = ParseClock("100x"); err != nil {
+		t.Fatal(err)
+	}
+	vm, out = clockProgram(t, "DEL 2000\nTIME\nOUT\n", clock)
+	start = time.Now()
+	vm.Run()
+	if took := time.Since(start); took < 20*time.Millisecond || took > time.Second {
+		t.Errorf("DEL 2000 at 100x took %v, want about 20ms", took)
+	}
+	if ms, err := strconv.Atoi(strings.TrimSpace(out.String())); err != nil || ms < 2000 {
+		t.Errorf("TIME after DEL 2000 at 100x read %q, want at least 2000", out.String())
+	}
+
+	for _, mode := range []string{"0x", "-2x", "10", "fast"} {
+		if _, err := ParseClock(mode); err == nil {
+			t.Errorf("ParseClock(%q) didn't fail", mode)
+		}
+	}
+}
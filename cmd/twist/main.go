@@ -0,0 +1,247 @@
+//go:build !js
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"twist"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		panic("Please provide a file argument!")
+	}
+	switch os.Args[1] {
+	case "lsp":
+		if err := twist.ServeLSP(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "lsp:", err)
+			os.Exit(1)
+		}
+		return
+	case "disasm":
+		if len(os.Args) < 3 {
+			panic("Please provide a file argument!")
+		}
+		instructions, err := disasmInput(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := twist.Disassemble(os.Stdout, instructions); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	case "debug":
+		if len(os.Args) < 3 {
+			panic("Please provide a file argument!")
+		}
+		instructions, err := twist.LoadProgram(os.Args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		twist.NewDebugger(twist.NewVM(instructions), os.Stdout).Repl(os.Stdin)
+		return
+	case "cover":
+		if err := runCover(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	profilePath := flag.String("profile", "", "record a profile of the run, print a report to stderr and write it in pprof format to this file")
+	resumePath := flag.String("resume", "", "carry on from a VM snapshot instead of starting a program")
+	savePath := flag.String("save", "", "on interrupt (Ctrl+C), pause the program and write a VM snapshot to this file")
+	recordPath := flag.String("record", "", "record every INP response, DEL and output of the run to this session log")
+	replayPath := flag.String("replay", "", "re-run a recorded session log with the same input and no sleeps, checking the output matches")
+	searchPath := flag.String("path", "", "extra directories to look for IMPORTed modules in, separated like PATH, searched before TWIST_PATH")
+	clockMode := flag.String("clock", "real", "what DEL sleeps on: real, skip (no sleeping, time still advances) or a speed like 10x")
+	schedule := flag.String("schedule", "threads", "how SPAWNed threads run: threads (goroutines), roundrobin, or random:seed to take turns in a reproducible order")
+	flag.Parse()
+
+	var session *twist.Session
+	if *replayPath != "" {
+		file, err := os.Open(*replayPath)
+		if err != nil {
+			fmt.Println("Error opening session:", err)
+			os.Exit(1)
+		}
+		session, err = twist.ReplaySession(file)
+		file.Close()
+		if err != nil {
+			fmt.Println("Error reading session:", err)
+			os.Exit(1)
+		}
+	}
+
+	println("init")
+	var vm *twist.VM
+	path := flag.Arg(0)
+	if path == "" && session != nil {
+		path = session.Program()
+	}
+	if *resumePath != "" {
+		var err error
+		vm, err = twist.LoadSnapshot(*resumePath)
+		if err != nil {
+			fmt.Println("Error resuming:", err)
+			os.Exit(1)
+		}
+		path = *resumePath
+	} else {
+		if path == "" {
+			panic("Please provide a file argument!")
+		}
+		loader := twist.NewLoader()
+		if *searchPath != "" {
+			loader.SearchPath = append(filepath.SplitList(*searchPath), loader.SearchPath...)
+		}
+		instructions, err := loader.Load(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		vm = twist.NewVM(instructions)
+	}
+	clock, err := twist.ParseClock(*clockMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	vm.SetClock(clock)
+	scheduler, err := twist.ParseSchedule(*schedule)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *schedule == "random" {
+		fmt.Fprintln(os.Stderr, "schedule", scheduler)
+	}
+	vm.Schedule(scheduler)
+	var profiler *twist.Profiler
+	if *profilePath != "" {
+		profiler = twist.NewProfiler(vm.Program(), path)
+		vm.SetProfiler(profiler)
+	}
+	if *recordPath != "" {
+		file, err := os.Create(*recordPath)
+		if err != nil {
+			fmt.Println("Error creating session:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		session = twist.RecordSession(file, path)
+	}
+	if session != nil {
+		session.Attach(vm)
+	}
+	if *savePath != "" {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		go func() {
+			<-interrupts
+			vm.Stop()
+		}()
+	}
+
+	vm.Run()
+
+	if session != nil {
+		if err := session.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if vm.Paused() {
+		if err := twist.SaveSnapshot(vm, *savePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error saving snapshot:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "\npaused, resume with --resume %s\n", *savePath)
+	}
+	if profiler != nil {
+		if err := writeProfile(profiler, *profilePath); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing profile:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func writeProfile(p *twist.Profiler, path string) error {
+	if err := p.WriteReport(os.Stderr, 20); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return p.WritePprof(file)
+}
+
+// disasmInput is the program in a .whl file, or the one a snapshot saved with --save was running
+func disasmInput(path string) ([]twist.Instruction, error) {
+	if filepath.Ext(path) != ".json" {
+		return twist.LoadProgram(path)
+	}
+	s, err := twist.ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	return s.Program, nil
+}
+
+// runCover runs a program with coverage on and reports it: `twist cover [-html out.html] file.whl`
+func runCover(arguments []string) error {
+	flags := flag.NewFlagSet("cover", flag.ExitOnError)
+	htmlPath := flags.String("html", "", "write the source annotated with coverage to this HTML file")
+	flags.Parse(arguments)
+	if flags.NArg() < 1 {
+		return fmt.Errorf("Please provide a file argument!")
+	}
+	path := flags.Arg(0)
+
+	source, err := twist.ReadSource(path)
+	if err != nil {
+		return fmt.Errorf("Error opening file: %v", err)
+	}
+	instructions, err := twist.NewLoader().LoadSource(path, source)
+	if err != nil {
+		return err
+	}
+
+	vm := twist.NewVM(instructions)
+	coverage := twist.NewCoverage(instructions)
+	vm.SetCoverage(coverage)
+	func() {
+		// a program that dies still has coverage worth reporting
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Fprintf(os.Stderr, "\nprogram stopped: %v\n", r)
+			}
+		}()
+		vm.Run()
+	}()
+
+	fmt.Println()
+	if err := coverage.WriteSummary(os.Stdout); err != nil {
+		return err
+	}
+	if *htmlPath == "" {
+		return nil
+	}
+	file, err := os.Create(*htmlPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return coverage.WriteHTML(file, path, source)
+}
@@ -0,0 +1,187 @@
+//go:build js
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+
+	"twist"
+)
+
+// The playground build: GOOS=js GOARCH=wasm go build -o server/twist.wasm ./cmd/twist
+// Programs run on their own goroutine so the page can pause them and take a snapshot while they DEL.
+// SPAWNed threads take turns on that goroutine rather than getting their own, see playgroundSchedule
+
+var playgroundVM *twist.VM
+
+// playgroundDone is closed when the Run of playgroundVM returns
+var playgroundDone chan struct{}
+
+// playgroundSnapshotting is set while snapshotTwist has the program paused, so it isn't reported as paused
+var playgroundSnapshotting bool
+
+// playgroundClock is the --clock mode programs in the page run with
+var playgroundClock = "real"
+
+// playgroundSchedule is the --schedule mode programs in the page run with
+var playgroundSchedule = "roundrobin"
+
+func runTwistCode(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 {
+		fmt.Println("No code provided")
+		return nil
+	}
+	instructions, err := twist.NewLoader().LoadSource("", args[0].String())
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	startPlayground(twist.NewVM(instructions))
+	return nil
+}
+
+func pauseTwist(this js.Value, args []js.Value) interface{} {
+	if playgroundVM != nil {
+		playgroundVM.Stop()
+	}
+	return nil
+}
+
+// snapshotTwist returns a promise of the state of the current program as the same JSON `--save` writes.
+// A running program is paused between instructions for the snapshot and then carries on,
+// waiting for that can't block here since a DEL needs the page's event loop to wake up
+func snapshotTwist(this js.Value, args []js.Value) interface{} {
+	var executor js.Func
+	executor = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve := args[0]
+		go func() {
+			defer executor.Release()
+			resolve.Invoke(takeSnapshot())
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(executor)
+}
+
+func takeSnapshot() interface{} {
+	vm, done := playgroundVM, playgroundDone
+	if vm == nil {
+		return nil
+	}
+	running := true
+	select {
+	case <-done:
+		running = false
+	default:
+		playgroundSnapshotting = true
+		vm.Stop()
+		<-done
+		playgroundSnapshotting = false
+	}
+	// the program may have ended by itself before it saw the Stop
+	if running && vm.Paused() {
+		defer runPlayground(vm)
+	}
+	s, err := vm.Snapshot()
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return string(data)
+}
+
+// resumeTwist carries on from a snapshot, taken here or by `twist --save` on the CLI
+func resumeTwist(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 {
+		fmt.Println("No snapshot provided")
+		return nil
+	}
+	s, err := twist.ParseSnapshot([]byte(args[0].String()))
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	vm := twist.NewVM(nil)
+	if err := vm.Restore(s); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	startPlayground(vm)
+	return nil
+}
+
+// setClockTwist picks what DEL sleeps on for the next run: "real", "skip" or a speed like "10x"
+func setClockTwist(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := twist.ParseClock(args[0].String()); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	playgroundClock = args[0].String()
+	return nil
+}
+
+// setScheduleTwist picks how SPAWNed threads run for the next run: "roundrobin", "random:seed" or "threads"
+func setScheduleTwist(this js.Value, args []js.Value) interface{} {
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := twist.ParseSchedule(args[0].String()); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	playgroundSchedule = args[0].String()
+	return nil
+}
+
+func startPlayground(vm *twist.VM) {
+	clock, _ := twist.ParseClock(playgroundClock)
+	vm.SetClock(clock)
+	scheduler, _ := twist.ParseSchedule(playgroundSchedule)
+	if playgroundSchedule == "random" {
+		fmt.Println("schedule", scheduler)
+	}
+	vm.Schedule(scheduler)
+	if playgroundVM != nil {
+		playgroundVM.Stop()
+	}
+	runPlayground(vm)
+}
+
+// runPlayground runs vm on its own goroutine as the program in the page
+func runPlayground(vm *twist.VM) {
+	done := make(chan struct{})
+	playgroundVM, playgroundDone = vm, done
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Println(r)
+			}
+		}()
+		vm.Run()
+		if vm.Paused() && !playgroundSnapshotting {
+			fmt.Println("paused")
+		}
+	}()
+}
+
+func main() {
+	println("Twist Wasm Initialized")
+	js.Global().Set("runTwistCode", js.FuncOf(runTwistCode))
+	js.Global().Set("pauseTwist", js.FuncOf(pauseTwist))
+	js.Global().Set("snapshotTwist", js.FuncOf(snapshotTwist))
+	js.Global().Set("resumeTwist", js.FuncOf(resumeTwist))
+	js.Global().Set("setClockTwist", js.FuncOf(setClockTwist))
+	js.Global().Set("setScheduleTwist", js.FuncOf(setScheduleTwist))
+	<-make(chan bool)
+}
@@ -0,0 +1,204 @@
+package twist
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Coverage records which CWheel positions ran and which way every JIZ went
+type Coverage struct {
+	program []Instruction
+	hits    []int
+	// jumped and fell count the times a JIZ jumped (CMPFLAG false) and fell through to the next instruction
+	jumped []int
+	fell   []int
+}
+
+func NewCoverage(program []Instruction) *Coverage {
+	return &Coverage{
+		program: program,
+		hits:    make([]int, len(program)),
+		jumped:  make([]int, len(program)),
+		fell:    make([]int, len(program)),
+	}
+}
+
+func (c *Coverage) hit(index int) {
+	c.hits[index]++
+}
+
+func (c *Coverage) branch(index int, jumped bool) {
+	if jumped {
+		c.jumped[index]++
+	} else {
+		c.fell[index]++
+	}
+}
+
+// counted reports whether an instruction takes part in the percentages.
+// DEF is only ever run to skip over a body at the top level, so it says nothing about the function
+func (c *Coverage) counted(index int) bool {
+	return c.program[index].Mnemonic != "DEF"
+}
+
+type functionCoverage struct {
+	name            string
+	instructions    int
+	covered         int
+	branches        int
+	branchesCovered int
+	firstLine       int
+}
+
+func (f functionCoverage) percent() float64 {
+	if f.instructions == 0 {
+		return 100
+	}
+	return float64(f.covered) * 100 / float64(f.instructions)
+}
+
+// summarize rolls coverage up per DEF function, top level code is "main".
+// The last entry is the total for the whole program
+func (c *Coverage) summarize() []functionCoverage {
+	owners := functionMembership(c.program)
+	byName := make(map[string]*functionCoverage)
+	var order []string
+	total := functionCoverage{name: "total"}
+
+	for i, inst := range c.program {
+		if !c.counted(i) {
+			continue
+		}
+		name := owners[i]
+		if name == "" {
+			name = "main"
+		}
+		fn := byName[name]
+		if fn == nil {
+			fn = &functionCoverage{name: name, firstLine: inst.Line}
+			byName[name] = fn
+			order = append(order, name)
+		}
+		for _, f := range []*functionCoverage{fn, &total} {
+			f.instructions++
+			if c.hits[i] > 0 {
+				f.covered++
+			}
+			if inst.Mnemonic == "JIZ" {
+				f.branches += 2
+				if c.jumped[i] > 0 {
+					f.branchesCovered++
+				}
+				if c.fell[i] > 0 {
+					f.branchesCovered++
+				}
+			}
+		}
+	}
+
+	var out []functionCoverage
+	for _, name := range order {
+		out = append(out, *byName[name])
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].firstLine < out[j].firstLine })
+	return append(out, total)
+}
+
+// WriteSummary prints the coverage percentage of every function
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tINSTRUCTIONS\tCOVERED\tJIZ DIRECTIONS")
+	for _, fn := range c.summarize() {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%.1f%%\t%d/%d\n", fn.name, fn.covered, fn.instructions, fn.percent(), fn.branchesCovered, fn.branches)
+	}
+	return tw.Flush()
+}
+
+type coverageLine struct {
+	Number int
+	Text   string
+	Class  string
+	Note   string
+}
+
+var coverageTemplate = template.Must(template.New("cover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>{{.Path}} coverage</title>
+<style>
+body { font-family: sans-serif; background: #fafafa; }
+table.summary td, table.summary th { padding: 2px 12px; text-align: left; }
+pre { background: #fff; border: 1px solid #ddd; padding: 8px; }
+.line { display: block; }
+.num { color: #999; display: inline-block; width: 4em; }
+.covered { background: #d7f5d7; }
+.uncovered { background: #f8d0d0; }
+.partial { background: #f8efc0; }
+.note { color: #777; font-style: italic; }
+</style>
+</head>
+<body>
+<h2>{{.Path}}</h2>
+<table class="summary">
+<tr><th>Function</th><th>Instructions</th><th>Covered</th><th>JIZ directions</th></tr>
+{{range .Functions}}<tr><td>{{.Name}}</td><td>{{.Covered}}/{{.Instructions}}</td><td>{{.Percent}}</td><td>{{.BranchesCovered}}/{{.Branches}}</td></tr>
+{{end}}</table>
+<pre>{{range .Lines}}<span class="line {{.Class}}"><span class="num">{{.Number}}</span>{{.Text}}{{if .Note}} <span class="note">{{.Note}}</span>{{end}}</span>{{end}}</pre>
+</body>
+</html>
+`))
+
+// WriteHTML renders the source with every line shaded by coverage: green ran, red never ran,
+// yellow for a JIZ that only ever went one way
+func (c *Coverage) WriteHTML(w io.Writer, path, source string) error {
+	lines := strings.Split(source, "\n")
+	view := make([]coverageLine, len(lines))
+	for i, text := range lines {
+		view[i] = coverageLine{Number: i + 1, Text: text}
+	}
+	for i, inst := range c.program {
+		if !c.counted(i) || inst.File != "" || inst.Line >= len(view) {
+			continue
+		}
+		line := &view[inst.Line]
+		switch {
+		case c.hits[i] == 0:
+			line.Class = "uncovered"
+		case inst.Mnemonic == "JIZ" && (c.jumped[i] == 0 || c.fell[i] == 0):
+			line.Class = "partial"
+		default:
+			line.Class = "covered"
+		}
+		line.Note = fmt.Sprintf("× %d", c.hits[i])
+		if inst.Mnemonic == "JIZ" {
+			line.Note = fmt.Sprintf("× %d, jumped %d, fell through %d", c.hits[i], c.jumped[i], c.fell[i])
+		}
+	}
+
+	type functionView struct {
+		Name                                             string
+		Instructions, Covered, Branches, BranchesCovered int
+		Percent                                          string
+	}
+	var functions []functionView
+	for _, fn := range c.summarize() {
+		functions = append(functions, functionView{
+			Name:            fn.name,
+			Instructions:    fn.instructions,
+			Covered:         fn.covered,
+			Branches:        fn.branches,
+			BranchesCovered: fn.branchesCovered,
+			Percent:         fmt.Sprintf("%.1f%%", fn.percent()),
+		})
+	}
+	return coverageTemplate.Execute(w, map[string]interface{}{
+		"Path":      path,
+		"Functions": functions,
+		"Lines":     view,
+	})
+}
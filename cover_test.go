@@ -0,0 +1,47 @@
+package twist
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoverageRecordsBothJIZDirections(t *testing.T) {
+	const source = `DEF "unused" 0
+OUT
+RET
+NEWV 2
+ADD -1
+CMP 0
+JIZ -2
+JMP 3
+OUT
+CMP -1
+JIZ -2
+OUT "end"
+`
+	instructions, err := parseProgram(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(instructions)
+	c := NewCoverage(instructions)
+	vm.coverage = c
+	vm.Run()
+
+	// the loop's JIZ falls through to JMP back while the counter is 1 and jumps out at 0, the second one only falls through
+	if c.jumped[6] != 1 || c.fell[6] != 1 {
+		t.Errorf("the loop's JIZ jumped %d times and fell through %d, want 1 and 1", c.jumped[6], c.fell[6])
+	}
+	if c.jumped[10] != 0 || c.fell[10] != 1 {
+		t.Errorf("the second JIZ jumped %d times and fell through %d, want 0 and 1", c.jumped[10], c.fell[10])
+	}
+
+	want := []functionCoverage{
+		{name: "unused", instructions: 2, firstLine: 1},
+		{name: "main", instructions: 9, covered: 9, branches: 4, branchesCovered: 3, firstLine: 3},
+		{name: "total", instructions: 11, covered: 9, branches: 4, branchesCovered: 3},
+	}
+	if got := c.summarize(); !reflect.DeepEqual(got, want) {
+		t.Errorf("summary %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,462 @@
+package twist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// undoEntry holds everything a single instruction can change, saved just before it runs.
+// Only the wheel the instruction ran on can be mutated (CALL pushes a new one, RET pops it),
+// so a copy of that wheel plus the tops of the stacks is enough to step backwards.
+// Named wheels are shared by every frame, they are copied whole, and so are the caller's and the global
+// VWheel, which STOREP and STOREG can write to, and the generators, which RESUME and YIELD swap frames with.
+// Wheels and maps nested in cells are copied with the wheel holding them, so stepping back over a change to one
+// that is also held somewhere else leaves the two places with a copy each
+type undoEntry struct {
+	cursor     int
+	dir        int
+	depth      int
+	top        VWheel
+	frame      int
+	callDepth  int
+	callTop    int
+	args       []Value
+	named      map[string]VWheel
+	caller     VWheel
+	global     VWheel
+	generators map[int]*generator
+	lastGen    int
+
+	// filled in after the instruction ran
+	changes []string
+	cells   []int
+}
+
+// Debugger steps a VM forwards and backwards. Every step is recorded in an undo log of
+// VWheel mutations, cursor moves, CMPFLAG changes and calls/returns, so execution can be
+// rewound to any earlier instruction and carried on forward from there.
+// Output from OUT and input read by INP are not undone, INP reads again when stepped over a second time
+type Debugger struct {
+	vm          *VM
+	log         []undoEntry
+	breakpoints map[int]bool
+	finished    bool
+	out         io.Writer
+
+	// frames gives every VWheel on the dataStack an id, so two calls at the same depth can be told apart
+	frames    []int
+	nextFrame int
+}
+
+func NewDebugger(vm *VM, out io.Writer) *Debugger {
+	d := &Debugger{vm: vm, breakpoints: make(map[int]bool), out: out}
+	for range vm.dataStack {
+		d.pushFrame()
+	}
+	return d
+}
+
+func (d *Debugger) pushFrame() {
+	d.frames = append(d.frames, d.nextFrame)
+	d.nextFrame++
+}
+
+// copyWheel copies a wheel along with every wheel and map nested in its cells, so stepping on can't change the copy
+func copyWheel(w VWheel) VWheel {
+	return copyNested(w, make(map[*shared]*shared))
+}
+
+// copyNested copies each nested wheel and map once, copies maps the ones already seen to their copy so a wheel that holds itself works
+func copyNested(w VWheel, copies map[*shared]*shared) VWheel {
+	w.data = append([]Value(nil), w.data...)
+	w.entered = slices.Clone(w.entered)
+	for i, item := range w.data {
+		w.data[i] = copyValue(item, copies)
+	}
+	return w
+}
+
+func copyValue(v Value, copies map[*shared]*shared) Value {
+	switch v.kind {
+	case KindWheel:
+		inner, found := copies[v.p]
+		if !found {
+			inner = &shared{}
+			copies[v.p] = inner
+			inner.wheel = copyNested(v.p.wheel, copies)
+		}
+		v.p = inner
+	case KindMap:
+		inner, found := copies[v.p]
+		if !found {
+			inner = &shared{entries: make(valueMap, len(v.p.entries))}
+			copies[v.p] = inner
+			for key, item := range v.p.entries {
+				inner.entries[key] = copyValue(item, copies)
+			}
+		}
+		v.p = inner
+	}
+	return v
+}
+
+func (d *Debugger) capture() undoEntry {
+	vm := d.vm
+	entry := undoEntry{
+		cursor:    vm.C.cursor,
+		dir:       vm.C.dir,
+		depth:     len(vm.dataStack),
+		top:       copyWheel(vm.dataStack[len(vm.dataStack)-1]),
+		frame:     d.frames[len(d.frames)-1],
+		callDepth: len(vm.callStack),
+		args:      append([]Value(nil), vm.args...),
+		lastGen:   vm.lastGenerator,
+	}
+	if len(vm.callStack) > 0 {
+		entry.callTop = vm.callStack[len(vm.callStack)-1]
+	}
+	if entry.depth > 1 {
+		entry.caller = copyWheel(vm.dataStack[entry.depth-2])
+		entry.global = copyWheel(vm.dataStack[0])
+	}
+	entry.generators = copyGenerators(vm.generators)
+	if len(vm.named) > 0 {
+		entry.named = make(map[string]VWheel)
+		for name, wheel := range vm.named {
+			entry.named[name] = copyWheel(*wheel)
+		}
+	}
+	return entry
+}
+
+func (d *Debugger) restore(entry undoEntry) {
+	vm := d.vm
+	vm.C.cursor = entry.cursor
+	vm.C.dir = entry.dir
+
+	vm.dataStack = vm.dataStack[:min(len(vm.dataStack), entry.depth)]
+	for len(vm.dataStack) < entry.depth {
+		vm.dataStack = append(vm.dataStack, VWheel{})
+	}
+	vm.dataStack[entry.depth-1] = copyWheel(entry.top)
+	if entry.depth > 1 {
+		vm.dataStack[entry.depth-2] = copyWheel(entry.caller)
+		vm.dataStack[0] = copyWheel(entry.global)
+	}
+
+	d.frames = d.frames[:min(len(d.frames), entry.depth)]
+	for len(d.frames) < entry.depth {
+		d.frames = append(d.frames, 0)
+	}
+	d.frames[entry.depth-1] = entry.frame
+
+	vm.callStack = vm.callStack[:min(len(vm.callStack), entry.callDepth)]
+	if len(vm.callStack) < entry.callDepth {
+		vm.callStack = append(vm.callStack, entry.callTop)
+	}
+	vm.args = append([]Value(nil), entry.args...)
+	vm.generators = copyGenerators(entry.generators)
+	vm.lastGenerator = entry.lastGen
+	vm.named = nil
+	for name, wheel := range entry.named {
+		if vm.named == nil {
+			vm.named = make(map[string]*VWheel)
+		}
+		restored := copyWheel(wheel)
+		vm.named[name] = &restored
+	}
+	d.finished = false
+}
+
+// describe lists what the step recorded in entry changed, comparing it with the VM now
+func (d *Debugger) describe(entry *undoEntry) {
+	vm := d.vm
+	note := func(format string, a ...interface{}) {
+		entry.changes = append(entry.changes, fmt.Sprintf(format, a...))
+	}
+
+	if vm.C.cursor != entry.cursor+1 && !d.finished {
+		note("CWheel %d → %d", entry.cursor, vm.C.cursor)
+	}
+	if vm.C.dir != entry.dir {
+		note("CWheel dir %d → %d", entry.dir, vm.C.dir)
+	}
+	switch {
+	case len(vm.dataStack) > entry.depth:
+		note("call, new VWheel %v", vm.dataStack[len(vm.dataStack)-1].data)
+	case len(vm.dataStack) < entry.depth:
+		note("return, popped VWheel %v", entry.top.data)
+	}
+
+	// the wheel the instruction ran on, if it is still there
+	if len(vm.dataStack) >= entry.depth {
+		before, after := entry.top, vm.dataStack[entry.depth-1]
+		for i, v := range after.data {
+			if i >= len(before.data) {
+				note("cell %d = %v (new)", i, v)
+				entry.cells = append(entry.cells, i)
+			} else if !reflect.DeepEqual(before.data[i], v) {
+				note("cell %d: %v → %v", i, before.data[i], v)
+				entry.cells = append(entry.cells, i)
+			}
+		}
+		if after.cursor != before.cursor {
+			note("VWheel cursor %d → %d", before.cursor, after.cursor)
+		}
+		if after.dir != before.dir {
+			note("VWheel dir %d → %d", before.dir, after.dir)
+		}
+		if after.CMPFLAG != before.CMPFLAG {
+			note("CMPFLAG %v → %v", before.CMPFLAG, after.CMPFLAG)
+		}
+	}
+	if entry.depth > 1 && len(vm.dataStack) == entry.depth {
+		if after := vm.dataStack[entry.depth-2].data; !reflect.DeepEqual(entry.caller.data, after) {
+			note("caller %v → %v", entry.caller.data, after)
+		}
+		if after := vm.dataStack[0].data; entry.depth > 2 && !reflect.DeepEqual(entry.global.data, after) {
+			note("global %v → %v", entry.global.data, after)
+		}
+	}
+	for _, name := range vm.wheelNames() {
+		before, existed := entry.named[name]
+		after := *vm.named[name]
+		if !existed {
+			note("new wheel %q", name)
+		} else if !reflect.DeepEqual(before.data, after.data) || before.cursor != after.cursor || before.dir != after.dir || before.CMPFLAG != after.CMPFLAG {
+			note("wheel %q %v → %v", name, before.data, after.data)
+		}
+	}
+	if before, after := entry.top.active, vm.dataStack[len(vm.dataStack)-1].active; len(vm.dataStack) == entry.depth && before != after {
+		note("using wheel %q → %q", before, after)
+	}
+	if !reflect.DeepEqual(entry.args, vm.args) && !(len(entry.args) == 0 && len(vm.args) == 0) {
+		note("args %v → %v", entry.args, vm.args)
+	}
+}
+
+// Forward runs one instruction and records how to undo it.
+// A runtime error leaves the VM as it was before the instruction
+func (d *Debugger) Forward() (err error) {
+	if d.finished || d.vm.C.cursor >= len(d.vm.C.data) {
+		d.finished = true
+		return fmt.Errorf("program has ended")
+	}
+	entry := d.capture()
+	defer func() {
+		if r := recover(); r != nil {
+			d.restore(entry)
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	depth := len(d.vm.dataStack)
+	if !d.vm.Step() || d.vm.C.cursor >= len(d.vm.C.data) {
+		d.finished = true
+	}
+	switch {
+	case len(d.vm.dataStack) > depth:
+		d.pushFrame()
+	case len(d.vm.dataStack) < depth:
+		d.frames = d.frames[:len(d.vm.dataStack)]
+	}
+	d.describe(&entry)
+	d.log = append(d.log, entry)
+	return nil
+}
+
+// Back undoes the last instruction, returning false at the start of the program
+func (d *Debugger) Back() bool {
+	if len(d.log) == 0 {
+		return false
+	}
+	entry := d.log[len(d.log)-1]
+	d.log = d.log[:len(d.log)-1]
+	d.restore(entry)
+	return true
+}
+
+// Continue runs forwards until a breakpoint, an error or the end of the program
+func (d *Debugger) Continue() error {
+	for {
+		if err := d.Forward(); err != nil {
+			return err
+		}
+		if d.finished || d.breakpoints[d.vm.C.cursor] {
+			return nil
+		}
+	}
+}
+
+// ReverseContinue runs backwards until a breakpoint or the start of the program
+func (d *Debugger) ReverseContinue() {
+	for d.Back() {
+		if d.breakpoints[d.vm.C.cursor] {
+			return
+		}
+	}
+}
+
+// Origin rewinds to just before the instruction that last wrote the cell under the cursor
+// of the current VWheel, so the instruction that produced a bad value is the next one to run
+func (d *Debugger) Origin() bool {
+	frame := d.frames[len(d.frames)-1]
+	cell := d.vm.dataStack[len(d.vm.dataStack)-1].cursor
+	for i := len(d.log) - 1; i >= 0; i-- {
+		entry := d.log[i]
+		if entry.frame != frame {
+			continue
+		}
+		for _, c := range entry.cells {
+			if c == cell {
+				for len(d.log) > i {
+					d.Back()
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Goto moves to step n, backwards through the log or forwards by running
+func (d *Debugger) Goto(n int) error {
+	for len(d.log) > n {
+		d.Back()
+	}
+	for len(d.log) < n && !d.finished {
+		if err := d.Forward(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Debugger) printLocation() {
+	vm := d.vm
+	if d.finished || vm.C.cursor >= len(vm.C.data) {
+		fmt.Fprintf(d.out, "step %d: program has ended\n", len(d.log))
+		return
+	}
+	inst := vm.C.data[vm.C.cursor]
+	fmt.Fprintf(d.out, "step %d: [%d] %s  %s\n", len(d.log), vm.C.cursor, inst.Location(), inst)
+}
+
+func (d *Debugger) printState() {
+	vm := d.vm
+	w := vm.wheel()
+	if active := vm.dataStack[len(vm.dataStack)-1].active; active != "" {
+		fmt.Fprintf(d.out, "using wheel %q\n", active)
+	}
+	fmt.Fprintf(d.out, "VWheel %v cursor %d dir %d CMPFLAG %v\n", w.data, w.cursor, w.dir, w.CMPFLAG)
+	for _, name := range vm.wheelNames() {
+		named := vm.named[name]
+		fmt.Fprintf(d.out, "wheel %q %v cursor %d\n", name, named.data, named.cursor)
+	}
+	fmt.Fprintf(d.out, "CWheel cursor %d dir %d, depth %d, call stack %v, args %v\n", vm.C.cursor, vm.C.dir, len(vm.dataStack), vm.callStack, vm.args)
+}
+
+func (d *Debugger) printHistory(n int) {
+	for i := max(0, len(d.log)-n); i < len(d.log); i++ {
+		entry := d.log[i]
+		inst := d.vm.C.data[entry.cursor]
+		fmt.Fprintf(d.out, "%5d [%d] %-20s %s\n", i, entry.cursor, inst, strings.Join(entry.changes, ", "))
+	}
+}
+
+const debuggerHelp = `s, step [n]        run n instructions
+b, back [n]        step n instructions backwards
+c, continue        run until a breakpoint or the end
+rc, rcontinue      run backwards until a breakpoint or the start
+break <idx>        break before the instruction at CWheel index idx
+delete <idx>       remove a breakpoint
+origin             rewind to the instruction that last wrote the cell under the VWheel cursor
+goto <step>        move to a step number, backwards or forwards
+i, info            show the VWheels, named wheels, stacks and CMPFLAG
+wheel              draw the current VWheel
+h, history [n]     show the last n steps and what they changed
+q, quit            leave the debugger`
+
+// Repl reads debugger commands until quit or the end of input
+func (d *Debugger) Repl(in io.Reader) {
+	reader := bufio.NewReader(in)
+	d.printLocation()
+	for {
+		fmt.Fprint(d.out, "(twist) ")
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		count := 1
+		if len(fields) > 1 {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				count = n
+			}
+		}
+
+		switch fields[0] {
+		case "s", "step":
+			for i := 0; i < count; i++ {
+				if err := d.Forward(); err != nil {
+					fmt.Fprintln(d.out, "error:", err)
+					break
+				}
+			}
+		case "b", "back":
+			for i := 0; i < count; i++ {
+				if !d.Back() {
+					fmt.Fprintln(d.out, "at the start of the program")
+					break
+				}
+			}
+		case "c", "continue":
+			if err := d.Continue(); err != nil {
+				fmt.Fprintln(d.out, "error:", err)
+			}
+		case "rc", "rcontinue":
+			d.ReverseContinue()
+		case "break", "delete":
+			if len(fields) < 2 {
+				fmt.Fprintln(d.out, "which CWheel index?")
+				continue
+			}
+			d.breakpoints[count] = fields[0] == "break"
+			continue
+		case "origin":
+			if !d.Origin() {
+				fmt.Fprintln(d.out, "nothing in the log wrote this cell")
+			}
+		case "goto":
+			if err := d.Goto(count); err != nil {
+				fmt.Fprintln(d.out, "error:", err)
+			}
+		case "i", "info":
+			d.printState()
+			continue
+		case "wheel":
+			d.vm.printDebug()
+			continue
+		case "h", "history":
+			if len(fields) < 2 {
+				count = 10
+			}
+			d.printHistory(count)
+			continue
+		case "q", "quit":
+			return
+		default:
+			fmt.Fprintln(d.out, debuggerHelp)
+			continue
+		}
+		d.printLocation()
+	}
+}
@@ -0,0 +1,153 @@
+package twist
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// state is the VM as a snapshot would save it, for comparing two points in a run
+func state(t *testing.T, vm *VM) string {
+	t.Helper()
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// debuggerPrograms are each stepped to their end and back to the start
+var debuggerPrograms = map[string]string{
+	// a call taking an argument and handing back a result, and both wheels turned around
+	"calls": `DEF "bump" 1
+ADD 10
+ADDARG
+RET
+NEWV 1
+NEWV 2
+ADDARG
+CALL "bump" %
+OUT "skipped"
+WHLDIRV -1
+MOVVW 1
+WHLDIRC 1
+OUT
+`,
+	// a named wheel every frame can reach, written from inside a call
+	"named wheels": `WHEEL "log"
+DEF "record" 1
+PUT "log"
+USE "log"
+ADD 1
+RET
+NEWV 1
+ADDARG
+CALL "record" %
+OUT "skipped"
+USE "log"
+GET "log"
+`,
+	// a call two deep writing to its caller's VWheel and the global one
+	"outer frames": `NEWV 10
+NEWV 20
+DEF "outer" 0
+NEWV 7
+CALL "inner"
+OUT "skipped"
+RET
+DEF "inner" 0
+LOADP
+ADD 1
+STOREP
+LOADG 1
+STOREG
+RET
+CALL "outer"
+OUT "skipped"
+`,
+	// a generator suspended and resumed until it returns
+	"generators": `DEF "two" 0
+NEWV 1
+YIELD
+NEWV 2
+YIELD
+RET
+GEN "two"
+MOVVW -1
+RESUME
+RESUME
+RESUME
+`,
+}
+
+func TestDebuggerStepsBackToEveryState(t *testing.T) {
+	for name, source := range debuggerPrograms {
+		vm, _ := loadSource(t, source)
+		d := NewDebugger(vm, io.Discard)
+		states := []string{state(t, vm)}
+		for !d.finished {
+			if err := d.Forward(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			states = append(states, state(t, vm))
+		}
+
+		for step := len(states) - 2; step >= 0; step-- {
+			if !d.Back() {
+				t.Fatalf("%s: Back stopped at step %d", name, step+1)
+			}
+			if got := state(t, vm); got != states[step] {
+				t.Fatalf("%s: stepping back to step %d left\n%s\nwant\n%s", name, step, got, states[step])
+			}
+		}
+		if d.Back() {
+			t.Errorf("%s: Back went past the start of the program", name)
+		}
+
+		// and forwards again from the start runs the same way
+		for step := 1; step < len(states); step++ {
+			if err := d.Forward(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got := state(t, vm); got != states[step] {
+				t.Fatalf("%s: running step %d again left\n%s\nwant\n%s", name, step, got, states[step])
+			}
+		}
+	}
+}
+
+func TestDebuggerOrigin(t *testing.T) {
+	const source = `NEWV 1
+NEWV 2
+ADD 5
+MOVVW 1
+ADD 1
+MOVVW -1
+OUT
+`
+	vm, _ := loadSource(t, source)
+	d := NewDebugger(vm, io.Discard)
+	if err := d.Continue(); err != nil {
+		t.Fatal(err)
+	}
+	// the cursor is back on the first cell, last written by ADD 5 and not by the ADD 1 next to it
+	if !d.Origin() {
+		t.Fatal("Origin found nothing that wrote the cell")
+	}
+	if vm.C.cursor != 2 || len(d.log) != 2 {
+		t.Errorf("Origin stopped at CWheel %d after %d steps, want ADD 5 at 2 after 2", vm.C.cursor, len(d.log))
+	}
+	if got := vm.dataStack[0].data[0].String(); got != "1" {
+		t.Errorf("the cell holds %s, want 1 as it was before ADD 5", got)
+	}
+
+	// a cell nothing has written since the start has no origin
+	d.Goto(0)
+	if d.Origin() {
+		t.Error("Origin found a write at the start of the program")
+	}
+}
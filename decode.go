@@ -0,0 +1,81 @@
+package twist
+
+// Programs are decoded once, when a VM is made or restored: every Instruction gets an op alongside it
+// with its handler, its jump targets and the function it calls already looked up, so Step doesn't find
+// anything by name. The Instructions are kept as they are for snapshots, the debugger and error messages
+
+// op is an Instruction decoded
+type op struct {
+	handler InstructionHandler
+	// jumps is where a JMP or JIZ lands with the CWheel going forward (direction 1) and backward
+	jumps [2]int
+	// fn is the DEF a CALL, SPAWN, GEN or FUNC names, nil for a host function or one that doesn't exist
+	fn *function
+	// ret is the RET a DEF skips over its body to, len(program) if there isn't one
+	ret int
+	// tail is set on a CALL whose return lands on its function's RET, see tailCall
+	tail bool
+	// returns is set on the instructions that come back to the one after them, RET and CALL
+	returns bool
+}
+
+func decodeProgram(instructions []Instruction, functions map[string]function) []op {
+	n := len(instructions)
+	code := make([]op, n)
+	ret := n
+	// walking backwards, ret is always the first RET after i
+	for i := n - 1; i >= 0; i-- {
+		inst := &instructions[i]
+		code[i].ret = ret
+		if inst.Mnemonic == "RET" {
+			ret = i
+		}
+		if def, found := lookupMnemonic(inst.Mnemonic); found {
+			code[i].handler = def.Handler
+		}
+		code[i].jumps = [2]int{jumpTarget(i, inst.Argument, 1, n), jumpTarget(i, inst.Argument, 0, n)}
+		if fn, found := functions[inst.ArgumentStr]; found && namesFunction(inst.Mnemonic) {
+			code[i].fn = &fn
+		}
+		code[i].tail = inst.Mnemonic == "CALL" && isTailCall(instructions, i)
+		code[i].returns = inst.Mnemonic == "RET" || inst.Mnemonic == "CALL"
+	}
+	return code
+}
+
+// isTailCall reports whether the CALL at i returns straight onto the RET that ends its function.
+// A return lands two past the CALL, the instruction right after it is skipped, so that is where the RET has to be,
+// with nothing between that starts or ends a function
+func isTailCall(instructions []Instruction, i int) bool {
+	if i+2 >= len(instructions) || instructions[i+2].Mnemonic != "RET" {
+		return false
+	}
+	skipped := instructions[i+1].Mnemonic
+	return skipped != "DEF" && skipped != "RET"
+}
+
+// op is the decoded instruction under the CWheel cursor
+func (vm *VM) op() *op {
+	return &vm.C.code[vm.C.cursor]
+}
+
+// jump is where a JMP or JIZ lands going in direction dir
+func (o *op) jump(dir int) int {
+	if dir == 1 {
+		return o.jumps[0]
+	}
+	return o.jumps[1]
+}
+
+// lookupFunction finds the DEF that runs for name at the instruction under the cursor,
+// already resolved unless it came from a reference
+func (vm *VM) lookupFunction(name string, inst *Instruction) (function, bool) {
+	if name == inst.ArgumentStr {
+		if fn := vm.op().fn; fn != nil {
+			return *fn, true
+		}
+		return function{}, false
+	}
+	fn, found := vm.functions[name]
+	return fn, found
+}
@@ -0,0 +1,114 @@
+package twist
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// String formats an instruction back into source form
+func (inst Instruction) String() string {
+	parts := []string{inst.Mnemonic}
+	if len(inst.ArgumentStr) > 0 {
+		parts = append(parts, strconv.Quote(inst.ArgumentStr))
+	}
+	if inst.Argument != 0 || requiresNumber(inst) {
+		parts = append(parts, strconv.Itoa(inst.Argument))
+	}
+	if inst.ArgumentF != 0 {
+		parts = append(parts, strconv.FormatFloat(inst.ArgumentF, 'f', -1, 64))
+	}
+	if inst.Args {
+		parts = append(parts, "%")
+	}
+	if inst.Alias != "" {
+		parts = append(parts, "as", inst.Alias)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Location is the source line of an instruction, prefixed with its module for imported ones
+func (inst Instruction) Location() string {
+	if inst.File != "" {
+		return fmt.Sprintf("%s:%d", inst.File, inst.Line+1)
+	}
+	return strconv.Itoa(inst.Line + 1)
+}
+
+// requiresNumber reports whether inst isn't valid without its int operand, so a zero is worth printing
+func requiresNumber(inst Instruction) bool {
+	def, known := lookupMnemonic(inst.Mnemonic)
+	if !known {
+		return len(inst.ArgumentStr) == 0 && !inst.Args && inst.ArgumentF == 0
+	}
+	return !def.accepts(shapeOf(inst), false)
+}
+
+// Disassemble prints the CWheel as VM.Run sees it: index, source line, owning function,
+// and where every relative JMP/JIZ/ERRH actually lands once the wheel wraps around
+func Disassemble(w io.Writer, instructions []Instruction) error {
+	n := len(instructions)
+	owners := functionMembership(instructions)
+	functions := collectFunctions(instructions)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "; %d instructions, %d functions\n", n, len(functions))
+	for i, inst := range instructions {
+		if inst.Mnemonic != "DEF" {
+			continue
+		}
+		end := "missing RET"
+		for j := i + 1; j < n; j++ {
+			if instructions[j].Mnemonic == "RET" {
+				end = fmt.Sprintf("RET @ %d", j)
+				break
+			}
+		}
+		fmt.Fprintf(tw, "; %s\targs %d\tentry %d\t%s\n", inst.ArgumentStr, inst.Argument, functions[inst.ArgumentStr].line, end)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "IDX\tLINE\tFUNCTION\tINSTRUCTION\tTARGET")
+
+	for i, inst := range instructions {
+		owner := owners[i]
+		if owner == "" {
+			owner = "-"
+		}
+		target := ""
+		if dest, ok := branchTarget(instructions, i); ok {
+			if dest < n {
+				target = fmt.Sprintf("-> %d (line %s)", dest, instructions[dest].Location())
+			} else {
+				target = "-> end"
+			}
+			if wrapsAround(instructions, i) {
+				target += " (wraps)"
+			}
+		} else if inst.Mnemonic == "CALL" && inst.ArgumentStr == "" {
+			target = "-> reference at cursor"
+		} else if inst.Mnemonic == "CALL" {
+			if fn, found := functions[inst.ArgumentStr]; found && fn.line < n {
+				target = fmt.Sprintf("-> %d (line %s)", fn.line, instructions[fn.line].Location())
+			} else {
+				target = "-> undefined"
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i, inst.Location(), owner, inst, target)
+	}
+	return tw.Flush()
+}
+
+// wrapsAround reports whether the jump at i only lands where it does because of the mod on the CWheel
+func wrapsAround(instructions []Instruction, i int) bool {
+	from := i
+	if instructions[i].Mnemonic == "ERRH" {
+		from = i - 1
+	}
+	raw := from - instructions[i].Argument
+	if staticDirection(instructions, i) == 1 {
+		raw = from + instructions[i].Argument
+	}
+	return raw < 0 || raw >= len(instructions)
+}
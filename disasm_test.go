@@ -0,0 +1,108 @@
+package twist
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// disassembly maps each CWheel index to its TARGET column
+func disassembly(t *testing.T, source string) map[string]string {
+	t.Helper()
+	instructions, err := parseProgram(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Disassemble(&out, instructions); err != nil {
+		t.Fatal(err)
+	}
+	targets := make(map[string]string)
+	lines := strings.Split(out.String(), "\n")
+	header := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "IDX") {
+			header = i
+			break
+		}
+	}
+	column := strings.Index(lines[header], "TARGET")
+	for _, line := range lines[header+1:] {
+		if line == "" {
+			continue
+		}
+		target := ""
+		if len(line) > column {
+			target = strings.TrimSpace(line[column:])
+		}
+		targets[strings.Fields(line)[0]] = target
+	}
+	return targets
+}
+
+func TestDisassembleJumpTargets(t *testing.T) {
+	// the CWheel starts with direction 0, which subtracts the steps, so JMP 2 from 0 wraps to the end
+	const source = `JMP 2
+OUT
+ERRH "EMPTY_VWHEEL_ERROR" -2
+JMP 1
+OUT "x"
+WHLDIRC 1
+JMP 2
+OUT "y"
+`
+	targets := disassembly(t, source)
+	for idx, want := range map[string]string{
+		"0": "-> 6 (line 7) (wraps)",
+		"1": "",
+		// an ERRH jumps from the instruction that threw, 3 past OUT at 1
+		"2": "-> 4 (line 5)",
+		"3": "-> 2 (line 3)",
+		// after WHLDIRC 1 the steps are added, 6+2 goes past the end and around to 0
+		"6": "-> 0 (line 1) (wraps)",
+	} {
+		if got := targets[idx]; got != want {
+			t.Errorf("target of %s is %q, want %q", idx, got, want)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestDisassembleReportsWriteErrors(t *testing.T) {
+	instructions, err := parseProgram("OUT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Disassemble(failingWriter{}, instructions); err == nil {
+		t.Error("Disassemble into a writer that fails returned no error")
+	}
+}
+
+func TestDisassembleSnapshotProgram(t *testing.T) {
+	vm, _ := loadSource(t, "NEWV 1\nJMP 2\nOUT \"skipped\"\nOUT\n")
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveSnapshot(vm, path); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got bytes.Buffer
+	if err := Disassemble(&want, vm.Program()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Disassemble(&got, s.Program); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("the snapshot's program disassembles to\n%s\nwant\n%s", got.String(), want.String())
+	}
+}
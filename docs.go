@@ -0,0 +1,61 @@
+package twist
+
+// builtins are the instructions the VM comes with, in the order of the readme
+var builtins = []InstructionDef{
+	{"DEL", "DEL milliseconds", "Delays program execution for the specified number of milliseconds. `DEL %` takes the delay from the argument stack.", []Shape{OperandInt, OperandArgs}, (*VM).opDEL},
+	{"TIME", "TIME", "Pushes the milliseconds elapsed since the program started onto the current VWheel, read from the same (possibly virtual) clock `DEL` sleeps on.", []Shape{0}, (*VM).opTIME},
+	{"DEF", "DEF function_name argument_count", "Defines a function with a given name and the number of arguments it expects. The function's code block ends with a `RET` instruction.", []Shape{OperandString, OperandString | OperandInt}, (*VM).opDEF},
+	{"CALL", "CALL [function_name] [argument_count | %]", "Calls a function. It can be called with an explicit number of arguments to be taken from the argument stack, or `%` to take as many as the `DEF` declares. Without a name it calls the function the VWheel cursor holds a reference to. Embedders can register Go functions to call the same way.", []Shape{OperandString, OperandString | OperandInt, OperandString | OperandArgs, 0, OperandInt, OperandArgs}, (*VM).opCALL},
+	{"FUNC", "FUNC function_name", "Pushes a reference to a function onto the current VWheel, for a `CALL` without a name to call.", []Shape{OperandString}, (*VM).opFUNC},
+	{"RET", "RET", "Returns from a function call and pops its VWheel. At the top level it ends the program.", []Shape{0}, (*VM).opRET},
+	{"JIZ", "JIZ steps", "\"Jump If Zero\". If the `CMPFLAG` of the current VWheel is `false`, the CWheel's cursor is moved by the specified number of `steps`. Negative steps go forward unless `WHLDIRC 1` was used.", []Shape{OperandInt, OperandString | OperandInt}, (*VM).opJIZ},
+	{"JMP", "JMP steps", "JIZ, but without any of the IZ. Jumps always, regardless of the current CMPFLAG state.", []Shape{OperandInt, OperandString | OperandInt}, (*VM).opJMP},
+	{"WHLDIRV", "WHLDIRV direction", "Sets the direction of the current VWheel. `1` for forward, `-1` for backward.", []Shape{OperandInt}, (*VM).opWHLDIRV},
+	{"WHLDIRC", "WHLDIRC direction", "Sets the direction of the CWheel. `1` for forward, `-1` for backward.", []Shape{OperandInt}, (*VM).opWHLDIRC},
+	{"NEWV", "NEWV value", "Pushes a new value (integer or string) onto the current VWheel.", []Shape{OperandInt, OperandString}, (*VM).opNEWV},
+	{"MOVVW", "MOVVW steps", "Moves the cursor of the current VWheel by the specified number of `steps` in its current direction.", []Shape{OperandInt}, (*VM).opMOVVW},
+	{"ADDARG", "ADDARG", "Adds the value at the current VWheel cursor to the global argument stack.", []Shape{0}, (*VM).opADDARG},
+	{"ADD", "ADD [value | %]", "Addition. With an integer it adds to the cursor value, with `%` it sums values popped from the argument stack, with nothing it sums the whole VWheel into the cursor.", []Shape{0, OperandInt, OperandArgs, OperandInt | OperandArgs}, (*VM).opADD},
+	{"SUB", "SUB [value | %]", "Subtraction. With a count it subtracts values popped from the argument stack, with nothing it subtracts every value in the VWheel from the first.", []Shape{0, OperandInt, OperandArgs, OperandInt | OperandArgs}, (*VM).opSUB},
+	{"MUL", "MUL [value | %]", "Multiplication. With an integer it multiplies the cursor value, with `%` it multiplies values popped from the argument stack, with nothing it multiplies the whole VWheel.", []Shape{0, OperandInt, OperandArgs, OperandInt | OperandArgs}, (*VM).opMUL},
+	{"DIV", "DIV [value | %]", "Division. With a count it divides values popped from the argument stack, with nothing it divides the first value in the VWheel by every other one.", []Shape{0, OperandInt, OperandArgs, OperandInt | OperandArgs}, (*VM).opDIV},
+	{"CAT", "CAT [string | %]", "Concatenation. With a string it appends it to the cursor value, with `%` it joins values popped from the argument stack (`CAT 0 %` makes an empty string), with nothing it joins the whole VWheel into the cursor. Numbers are joined the way `OUT` prints them.", []Shape{0, OperandString, OperandArgs, OperandInt | OperandArgs}, (*VM).opCAT},
+	{"LEN", "LEN", "Pushes the number of characters in the value at the VWheel cursor onto the VWheel, or the number of cells or keys if it is a wheel or a map.", []Shape{0}, (*VM).opLEN},
+	{"SIZE", "SIZE", "Pushes the number of values in the current VWheel onto it.", []Shape{0}, (*VM).opSIZE},
+	{"NEST", "NEST", "Puts a new empty wheel in the cell at the VWheel cursor, or pushes one onto an empty VWheel.", []Shape{0}, (*VM).opNEST},
+	{"ENTER", "ENTER", "Makes the wheel in the cell at the VWheel cursor the one instructions work on, with its own cursor, direction and `CMPFLAG`.", []Shape{0}, (*VM).opENTER},
+	{"EXIT", "EXIT", "Goes back out of the wheel `ENTER` went into, to the wheel holding it.", []Shape{0}, (*VM).opEXIT},
+	{"NEWM", "NEWM", "Puts a new empty map in the cell at the VWheel cursor, or pushes one onto an empty VWheel.", []Shape{0}, (*VM).opNEWM},
+	{"MPUT", "MPUT [%]", "Stores a value in the map at the VWheel cursor under a key. The key and value are the next two cells in the VWheel's direction, or with `%` taken from the front of the argument stack, key first.", []Shape{0, OperandArgs}, (*VM).opMPUT},
+	{"MGET", "MGET [%]", "Pushes the value stored under a key in the map at the VWheel cursor onto the VWheel, the key being the next cell or with `%` taken from the argument stack. `CMPFLAG` is set to false, and nothing pushed, if there is no such key.", []Shape{0, OperandArgs}, (*VM).opMGET},
+	{"MDEL", "MDEL [%]", "Removes a key from the map at the VWheel cursor, taking the key like `MGET`. `CMPFLAG` says whether it was there.", []Shape{0, OperandArgs}, (*VM).opMDEL},
+	{"MKEYS", "MKEYS", "Pushes every key of the map at the VWheel cursor onto the VWheel, numbers first and then strings, each in order.", []Shape{0}, (*VM).opMKEYS},
+	{"WHEEL", "WHEEL \"name\"", "Creates a named global wheel, shared by every function. Does nothing if it already exists.", []Shape{OperandString}, (*VM).opWHEEL},
+	{"USE", "USE [\"name\"]", "Makes a named wheel the one instructions work on, until `USE` with no name goes back to the function's own VWheel. A `CALL` starts on its own VWheel and `RET` goes back to the caller's choice.", []Shape{0, OperandString}, (*VM).opUSE},
+	{"PUT", "PUT \"name\"", "Pushes a copy of the value at the cursor of the wheel in use onto a named wheel.", []Shape{OperandString}, (*VM).opPUT},
+	{"GET", "GET \"name\"", "Pushes a copy of the value at a named wheel's cursor onto the wheel in use.", []Shape{OperandString}, (*VM).opGET},
+	{"LOADP", "LOADP [steps]", "Pushes a copy of the caller's cell `steps` away from its cursor onto the wheel in use.", []Shape{0, OperandInt}, (*VM).opLOADP},
+	{"STOREP", "STOREP [steps]", "Overwrites the caller's cell `steps` away from its cursor with the value at the cursor.", []Shape{0, OperandInt}, (*VM).opSTOREP},
+	{"LOADG", "LOADG [steps]", "Pushes a copy of the global VWheel's cell `steps` away from its cursor onto the wheel in use.", []Shape{0, OperandInt}, (*VM).opLOADG},
+	{"STOREG", "STOREG [steps]", "Overwrites the global VWheel's cell `steps` away from its cursor with the value at the cursor.", []Shape{0, OperandInt}, (*VM).opSTOREG},
+	{"SPAWN", "SPAWN function_name [argument_count | %]", "Runs a function on a thread of its own, taking its arguments like `CALL`, and pushes the thread's id onto the current VWheel.", []Shape{OperandString, OperandString | OperandInt, OperandString | OperandArgs}, (*VM).opSPAWN},
+	{"SEND", "SEND \"gear\"", "Sends the value at the VWheel cursor through a named gear, waiting until a `RECV` on the same gear takes it.", []Shape{OperandString}, (*VM).opSEND},
+	{"RECV", "RECV \"gear\"", "Waits for a value to come through a named gear and pushes it onto the current VWheel.", []Shape{OperandString}, (*VM).opRECV},
+	{"JOIN", "JOIN", "Waits for the thread whose id is at the VWheel cursor to return, then moves what it left on its argument stack onto this one.", []Shape{0}, (*VM).opJOIN},
+	{"GEN", "GEN function_name [argument_count | %]", "Sets up a generator for a function, taking its arguments like `CALL` without running it, and pushes the generator's id onto the current VWheel.", []Shape{OperandString, OperandString | OperandInt, OperandString | OperandArgs}, (*VM).opGEN},
+	{"RESUME", "RESUME", "Runs the generator whose id is at the VWheel cursor until it `YIELD`s, pushing the value onto the VWheel and setting `CMPFLAG` to true. Once the generator has returned, `CMPFLAG` is set to false instead.", []Shape{0}, (*VM).opRESUME},
+	{"YIELD", "YIELD", "Suspends a generator, handing the value at its cursor back to the `RESUME`. The next `RESUME` carries on after the `YIELD` with the same VWheel.", []Shape{0}, (*VM).opYIELD},
+	{"CMP", "CMP [value | %]", "Compares the value at the VWheel cursor with a given value or the value at the front of the argument stack, which `CMP %` leaves there. Integers check if the cursor's value is greater, strings check for equality. The result is stored in `CMPFLAG`.", []Shape{0, OperandInt, OperandString, OperandArgs}, (*VM).opCMP},
+	{"OUT", "OUT [string]", "If a string argument is provided, it prints the string. Otherwise, it prints the value at the current VWheel cursor.", []Shape{0, OperandString}, (*VM).opOUT},
+	{"INP", "INP [prompt_string]", "Prompts the user for input and stores the result at the current VWheel cursor, as an integer if it parses as one.", []Shape{0, OperandString}, (*VM).opINP},
+	{"DBGPRINTV", "DBGPRINTV", "Prints a visual representation of the current VWheel, showing its data, cursor position, and structure.", []Shape{0}, (*VM).opDBGPRINTV},
+	{"DBGPRINTC", "DBGPRINTC", "Prints a visual representation of the CWheel, showing all instructions and the current execution cursor.", []Shape{0}, (*VM).opDBGPRINTC},
+	{"ARGVIEW", "ARGVIEW", "Prints the contents of the current argument stack.", []Shape{0}, (*VM).opARGVIEW},
+	{"POPARG", "POPARG", "Takes the value at the front of the argument stack, the one the next `CALL` would get first, and pushes it onto the current VWheel.", []Shape{0}, (*VM).opPOPARG},
+	{"PEEKARG", "PEEKARG", "Pushes a copy of the value at the front of the argument stack onto the current VWheel, leaving it there.", []Shape{0}, (*VM).opPEEKARG},
+	{"DUPARG", "DUPARG", "Duplicates the value at the front of the argument stack, so it is taken twice.", []Shape{0}, (*VM).opDUPARG},
+	{"CLEARARGS", "CLEARARGS", "Empties the argument stack.", []Shape{0}, (*VM).opCLEARARGS},
+	{"ARGC", "ARGC", "Pushes the number of values on the argument stack onto the current VWheel.", []Shape{0}, (*VM).opARGC},
+	{"IMPORT", "IMPORT \"path\" [as name]", "Links the functions of another .whl file into the program, callable as `CALL \"name.function\"`. The path is relative to the importing file, then the search path. The name defaults to the file name.", []Shape{OperandString, OperandString | OperandAlias}, nil},
+	{"ERRH", "ERRH [error] steps", "Handles an error thrown by the instruction right before it, or any error if no name is given, by jumping like `JMP`.", []Shape{OperandInt, OperandString, OperandString | OperandInt}, nil},
+}
@@ -0,0 +1,147 @@
+package twist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHostFunction(t *testing.T) {
+	const source = `DEF "show" 1
+OUT
+RET
+NEWV 4
+ADDARG
+CALL "double" %
+OUT "skipped"
+CALL "show" 1
+OUT "skipped"
+NEWV "x"
+MOVVW 1
+ADDARG
+CALL "double" %
+ERRH "HOST_FUNCTION_ERROR" -2
+OUT "doubled"
+OUT "handled"
+`
+	instructions, err := NewLoader().LoadSource("", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(instructions)
+	out := new(bytes.Buffer)
+	vm.SetOutput(out, out)
+	vm.RegisterFunc("double", 1, func(args []Value) ([]Value, error) {
+		n, ok := args[0].Int()
+		if !ok {
+			return nil, fmt.Errorf("double wants a number, got %v", args[0])
+		}
+		return []Value{IntValue(2 * n)}, nil
+	})
+	vm.Run()
+	if got, want := out.String(), "8 \nhandled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestCall(t *testing.T) {
+	const source = `DEF "add" 2
+ADD
+ADDARG
+RET
+DEF "triple" 0
+NEWV "a"
+ADDARG
+NEWV 1
+MOVVW 1
+ADDARG
+NEWV 0
+MOVVW 1
+NEST
+ADDARG
+RET
+DEF "fail" 0
+ENTER
+RET
+OUT "main"
+`
+	vm, out := loadSource(t, source)
+	results, err := vm.Call("add", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{3}; !reflect.DeepEqual(results, want) {
+		t.Errorf("add returned %#v, want %#v", results, want)
+	}
+	if results, err = vm.Call("triple"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"a", 1, []interface{}{}}; !reflect.DeepEqual(results, want) {
+		t.Errorf("triple returned %#v, want %#v", results, want)
+	}
+
+	_, err = vm.Call("fail")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || !strings.HasPrefix(runtimeErr.Message, EMPTY_VWHEEL_ERROR) {
+		t.Errorf("fail returned %v, want a %s", err, EMPTY_VWHEEL_ERROR)
+	}
+	if out.Len() != 0 {
+		t.Errorf("a failed Call printed %q", out.String())
+	}
+	if vm.C.cursor != 0 || len(vm.dataStack) != 1 || len(vm.callStack) != 0 || len(vm.args) != 0 {
+		t.Errorf("after the error the CWheel cursor is %d with %d VWheels, %d return addresses and arguments %v, want the VM as it was",
+			vm.C.cursor, len(vm.dataStack), len(vm.callStack), vm.args)
+	}
+	if _, err := vm.Call("missing"); err == nil || !strings.HasPrefix(err.Error(), UNDEFINED_FUNCTION_ERROR) {
+		t.Errorf("calling a missing function returned %v", err)
+	}
+
+	vm.Run()
+	if got, want := out.String(), "main\n"; got != want {
+		t.Errorf("running the program after the calls printed %q, want %q", got, want)
+	}
+}
+
+func TestRegisteredInstruction(t *testing.T) {
+	if _, found := lookupMnemonic("SQUARE"); !found {
+		err := RegisterInstruction(InstructionDef{
+			Name:   "SQUARE",
+			Shapes: []Shape{0},
+			Handler: func(vm *VM, wheel *VWheel, args *[]Value, inst *Instruction) Flow {
+				cell, _ := wheel.Current()
+				n, ok := cell.Int()
+				if !ok {
+					vm.Throw(NUMERIC_DATA_ERROR, inst)
+					return Next
+				}
+				wheel.SetCurrent(IntValue(n * n))
+				return Next
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diags := checkProgram([]Instruction{{Mnemonic: "SQUARE", ArgumentStr: "x"}})
+	if len(diags) != 1 || diags[0].Severity != SeverityWarning {
+		t.Errorf("checking SQUARE \"x\" reported %v, want one warning", diags)
+	}
+
+	const source = `NEWV 3
+SQUARE
+OUT
+NEWV "x"
+MOVVW 1
+SQUARE
+ERRH "NUMERIC_DATA_ERROR" -2
+OUT "squared"
+OUT "handled"
+`
+	if got, want := runSource(t, source), "9 \nhandled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
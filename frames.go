@@ -0,0 +1,70 @@
+package twist
+
+import "fmt"
+
+// LOADP/STOREP and LOADG/STOREG reach past the current frame into the caller's VWheel
+// (one down the dataStack) or the global one at the bottom of the program's dataStack, so a helper function can update
+// program state directly instead of handing everything back through the argument stack.
+// A SPAWNed thread reaches the same global VWheel as the program, not the bottom of its own stack.
+// The cell is picked relative to that wheel's cursor, moving in its direction like MOVVW
+
+// outerCell finds the cell steps away from the cursor of an outer frame, depth is 1 for the caller
+// and 0 for the global frame. ok is false once an error has been thrown
+func (vm *VM) outerCell(depth int, inst *Instruction) (wheel *VWheel, index int, ok bool) {
+	if depth > 0 {
+		if len(vm.dataStack) < 2 {
+			vm.throwError(fmt.Sprintf("%s: no caller outside a function", BAD_ARGUMENT_ERROR), inst)
+			return nil, 0, false
+		}
+		wheel = &vm.dataStack[len(vm.dataStack)-2]
+	} else {
+		// the group's lock is held, the program's stack can't change under us
+		wheel = &vm.group.threads[0].dataStack[0]
+	}
+	if len(wheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return nil, 0, false
+	}
+	if wheel.dir == 1 {
+		index = mod(wheel.cursor+inst.Argument, len(wheel.data))
+	} else {
+		index = mod(wheel.cursor-inst.Argument, len(wheel.data))
+	}
+	return wheel, index, true
+}
+
+// load pushes a copy of an outer cell onto the wheel in use
+func (vm *VM) load(depth int, currentVWheel *VWheel, inst *Instruction) Flow {
+	if wheel, index, ok := vm.outerCell(depth, inst); ok {
+		currentVWheel.data = append(currentVWheel.data, wheel.data[index])
+	}
+	return Next
+}
+
+// store overwrites an outer cell with the value at the cursor
+func (vm *VM) store(depth int, currentVWheel *VWheel, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	if wheel, index, ok := vm.outerCell(depth, inst); ok {
+		wheel.data[index] = currentVWheel.data[currentVWheel.cursor]
+	}
+	return Next
+}
+
+func (vm *VM) opLOADP(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	return vm.load(1, currentVWheel, inst)
+}
+
+func (vm *VM) opSTOREP(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	return vm.store(1, currentVWheel, inst)
+}
+
+func (vm *VM) opLOADG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	return vm.load(0, currentVWheel, inst)
+}
+
+func (vm *VM) opSTOREG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	return vm.store(0, currentVWheel, inst)
+}
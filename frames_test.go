@@ -0,0 +1,54 @@
+package twist
+
+import "testing"
+
+func TestOuterFrames(t *testing.T) {
+	const source = `NEWV 10
+NEWV 20
+DEF "outer" 0
+NEWV 7
+CALL "inner"
+OUT "skipped"
+OUT
+RET
+DEF "inner" 0
+LOADP
+ADD 1
+STOREP
+LOADG 1
+MOVVW 1
+ADD 1
+STOREG
+RET
+CALL "outer"
+OUT "skipped"
+OUT
+MOVVW 1
+OUT
+STOREP
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "stored"
+OUT "handled"
+`
+	// inner bumps the 7 in outer's VWheel, and writes the global 20 plus one over the 10 under the global cursor.
+	// The program has no caller, so its STOREP throws
+	if got, want := runSource(t, source), "8 \n21 \n20 \nhandled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+
+	// steps follow the global VWheel's direction, like MOVVW
+	const backwards = `NEWV 1
+NEWV 2
+NEWV 3
+WHLDIRV -1
+DEF "peek" 0
+LOADG 1
+OUT
+RET
+CALL "peek"
+OUT "skipped"
+`
+	if got, want := runSource(t, backwards), "3 \n"; got != want {
+		t.Errorf("LOADG 1 on a backwards global VWheel printed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package twist
+
+import "fmt"
+
+// A function reference is the name of a function held in a VWheel cell. FUNC "name" pushes one,
+// checking the function exists, and CALL without a name calls whatever function the cell under the cursor names,
+// so a program can keep functions in a wheel and pick one to call at runtime.
+// IMPORT renames FUNC "name" inside a module like it does CALL, a name put together at runtime isn't renamed
+
+// namesFunction reports whether an instruction's string operand is the name of a function
+func namesFunction(mnemonic string) bool {
+	switch mnemonic {
+	case "DEF", "CALL", "SPAWN", "GEN", "FUNC":
+		return true
+	}
+	return false
+}
+
+// callee is the function a CALL runs: the one it names, or for a CALL without a name the one the cursor cell names.
+// ok is false once an error has been thrown
+func (vm *VM) callee(currentVWheel *VWheel, inst *Instruction) (name string, ok bool) {
+	if inst.ArgumentStr != "" {
+		return inst.ArgumentStr, true
+	}
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return "", false
+	}
+	name, ok = currentVWheel.data[currentVWheel.cursor].Str()
+	if !ok {
+		vm.throwError(fmt.Sprintf("%s: %v is not a function", BAD_ARGUMENT_ERROR, currentVWheel.data[currentVWheel.cursor]), inst)
+		return "", false
+	}
+	return name, true
+}
+
+func (vm *VM) opFUNC(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	_, defined := vm.lookupFunction(inst.ArgumentStr, inst)
+	_, hosted := vm.hosts[inst.ArgumentStr]
+	if !defined && !hosted {
+		vm.throwError(fmt.Sprintf("%s '%s'", UNDEFINED_FUNCTION_ERROR, inst.ArgumentStr), inst)
+		return Next
+	}
+	currentVWheel.data = append(currentVWheel.data, StringValue(inst.ArgumentStr))
+	return Next
+}
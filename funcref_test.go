@@ -0,0 +1,72 @@
+package twist
+
+import "testing"
+
+func TestFunctionReferences(t *testing.T) {
+	const source = `DEF "inc" 1
+ADD 1
+OUT
+RET
+NEWV 4
+ADDARG
+FUNC "inc"
+MOVVW 1
+CALL %
+OUT "skipped"
+FUNC "nothing"
+ERRH "UNDEFINED_FUNCTION_ERROR" -2
+OUT "pushed"
+OUT "no function"
+MOVVW 1
+CALL
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "called"
+OUT "not a function"
+NEWV "nothing"
+MOVVW -1
+CALL
+ERRH "UNDEFINED_FUNCTION_ERROR" -2
+OUT "called"
+OUT "undefined"
+`
+	// CALL % through the reference FUNC pushed, FUNC of a missing function,
+	// then CALL on the 4 the cursor wrapped round to and on a string naming no function
+	if got, want := runSource(t, source), "5 \nno function\nnot a function\nundefined\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestFunctionReferenceInModule(t *testing.T) {
+	// IMPORT renames the FUNC "helper" inside the module to lib.helper, like a CALL
+	out := runModules(t, map[string]string{
+		"main.whl": `IMPORT "lib"
+CALL "lib.run"
+OUT "skipped"
+`,
+		"lib.whl": `DEF "run" 0
+FUNC "helper"
+CALL
+OUT "skipped"
+RET
+DEF "helper" 0
+OUT "helper"
+RET
+`,
+	})
+	if want := "helper\n"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+}
+
+func TestFunctionReferenceToHostFunction(t *testing.T) {
+	vm, out := loadSource(t, "FUNC \"hello\"\nCALL\nOUT \"skipped\"\n")
+	called := 0
+	vm.RegisterFunc("hello", 0, func(args []Value) ([]Value, error) {
+		called++
+		return nil, nil
+	})
+	vm.Run()
+	if called != 1 || out.Len() != 0 {
+		t.Errorf("the host function was called %d times and the program printed %q, want one call and nothing", called, out.String())
+	}
+}
@@ -0,0 +1,125 @@
+package twist
+
+import "fmt"
+
+// A generator is a DEF function that can stop part way with YIELD and carry on later.
+// GEN sets one up without running it and pushes its id, RESUME runs it until it YIELDs or returns.
+// YIELD doesn't discard the frame like RET does: its VWheel and the place after the YIELD are kept
+// in the generator, and the next RESUME pushes them back onto the stacks.
+// Both YIELD and the final RET land on the instruction right after the RESUME, nothing is skipped like after a CALL
+
+// generator is a suspended frame, ids count from 1 so a VWheel with generator 0 is an ordinary call
+type generator struct {
+	wheel  VWheel
+	cursor int
+	// running is set while the frame is on the stack
+	running bool
+}
+
+func copyGenerators(generators map[int]*generator) map[int]*generator {
+	if len(generators) == 0 {
+		return nil
+	}
+	out := make(map[int]*generator, len(generators))
+	for id, g := range generators {
+		gen := *g
+		gen.wheel = copyWheel(g.wheel)
+		out[id] = &gen
+	}
+	return out
+}
+
+// landAfter moves the CWheel cursor back to just after the RESUME at returnAddr-1.
+// The handler returns Next, so Step's check for running off the end of the program still applies
+func (vm *VM) landAfter(returnAddr int) {
+	vm.C.cursor = returnAddr - 1
+}
+
+func (vm *VM) opGEN(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	fn, found := vm.lookupFunction(inst.ArgumentStr, inst)
+	if !found {
+		vm.throwError(fmt.Sprintf("%s '%s'", UNDEFINED_FUNCTION_ERROR, inst.ArgumentStr), inst)
+		return Next
+	}
+	popped_args, ok := vm.callArgs(fn, inst)
+	if !ok {
+		return Next
+	}
+	// ids are never reused, so a RESUME holding on to a finished generator's id can't reach a newer one
+	vm.lastGenerator++
+	id := vm.lastGenerator
+	if vm.generators == nil {
+		vm.generators = make(map[int]*generator)
+	}
+	vm.generators[id] = &generator{
+		wheel:  VWheel{dir: 1, data: append([]Value(nil), popped_args...), generator: id},
+		cursor: fn.line,
+	}
+	currentVWheel.data = append(currentVWheel.data, IntValue(id))
+	return Next
+}
+
+func (vm *VM) opRESUME(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	id, ok := currentVWheel.data[currentVWheel.cursor].Int()
+	if !ok || id < 1 || id > vm.lastGenerator {
+		vm.throwError(fmt.Sprintf("%s: no generator %v to resume", BAD_ARGUMENT_ERROR, currentVWheel.data[currentVWheel.cursor]), inst)
+		return Next
+	}
+	gen, found := vm.generators[id]
+	// GEN handed the id out and the generator is gone, so it has returned
+	if !found {
+		currentVWheel.CMPFLAG = false
+		return Next
+	}
+	if gen.running {
+		vm.throwError(fmt.Sprintf("%s: generator %d is already running", BAD_ARGUMENT_ERROR, id), inst)
+		return Next
+	}
+	gen.running = true
+	vm.callStack = append(vm.callStack, vm.C.cursor+1)
+	vm.dataStack = append(vm.dataStack, gen.wheel)
+	gen.wheel = VWheel{}
+	vm.C.cursor = gen.cursor
+	return Jumped
+}
+
+func (vm *VM) opYIELD(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	frame := vm.dataStack[len(vm.dataStack)-1]
+	if frame.generator == 0 {
+		vm.throwError(fmt.Sprintf("%s: YIELD outside a generator", BAD_ARGUMENT_ERROR), inst)
+		return Next
+	}
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	value := currentVWheel.data[currentVWheel.cursor]
+
+	gen := vm.generators[frame.generator]
+	gen.wheel = frame
+	gen.cursor = vm.C.cursor + 1
+	gen.running = false
+	vm.dataStack = vm.dataStack[:len(vm.dataStack)-1]
+	returnAddr := vm.callStack[len(vm.callStack)-1]
+	vm.callStack = vm.callStack[:len(vm.callStack)-1]
+
+	caller := vm.wheel()
+	caller.data = append(caller.data, value)
+	caller.CMPFLAG = true
+	vm.landAfter(returnAddr)
+	return Next
+}
+
+// finishGenerator is RET from a generator's frame, it is deleted so a later RESUME of its id sees CMPFLAG false
+func (vm *VM) finishGenerator(id int) {
+	delete(vm.generators, id)
+	vm.dataStack = vm.dataStack[:len(vm.dataStack)-1]
+	returnAddr := vm.callStack[len(vm.callStack)-1]
+	vm.callStack = vm.callStack[:len(vm.callStack)-1]
+	vm.wheel().CMPFLAG = false
+	vm.landAfter(returnAddr)
+}
@@ -0,0 +1,103 @@
+package twist
+
+import "testing"
+
+func TestGenerators(t *testing.T) {
+	// the countdown from the readme, RESUME after the last YIELD sees CMPFLAG false and leaves the loop
+	const countdown = `DEF "countdown" 1
+YIELD
+ADD -1
+CMP 0
+JIZ -2
+JMP 4
+RET
+NEWV 3
+ADDARG
+GEN "countdown" %
+MOVVW 1
+RESUME
+JIZ -6
+MOVVW -2
+OUT
+MOVVW 2
+JMP 5
+OUT "unreached"
+OUT "done"
+`
+	if got, want := runSource(t, countdown), "3 \n2 \n1 \ndone\n"; got != want {
+		t.Errorf("countdown printed %q, want %q", got, want)
+	}
+
+	const outside = `NEWV 1
+YIELD
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "yielded"
+OUT "handled"
+`
+	if got, want := runSource(t, outside), "handled\n"; got != want {
+		t.Errorf("YIELD outside a generator printed %q, want %q", got, want)
+	}
+
+	const unknown = `NEWV 5
+RESUME
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "resumed"
+OUT "handled"
+`
+	if got, want := runSource(t, unknown), "handled\n"; got != want {
+		t.Errorf("RESUME of an id no GEN returned printed %q, want %q", got, want)
+	}
+}
+
+func TestGeneratorIdsAreNotReused(t *testing.T) {
+	const source = `DEF "one" 0
+NEWV 7
+YIELD
+RET
+DEF "drain" 0
+GEN "one"
+RESUME
+RESUME
+ADDARG
+MOVVW 1
+ADDARG
+RET
+`
+	vm, _ := loadSource(t, source)
+	for i := 0; i < 100; i++ {
+		results, err := vm.Call("drain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the id, then the value it yielded
+		if len(results) != 2 || results[0] != i+1 || results[1] != 7 {
+			t.Fatalf("call %d returned %v, want generator %d yielding 7", i, results, i+1)
+		}
+	}
+	if len(vm.generators) != 0 {
+		t.Errorf("100 generators run to the end left %d behind, want none", len(vm.generators))
+	}
+
+	// the first generator has finished, RESUME of its id mustn't run the second one
+	const stale = `DEF "one" 0
+NEWV 7
+YIELD
+RET
+GEN "one"
+RESUME
+RESUME
+GEN "one"
+RESUME
+JIZ -2
+OUT "resumed"
+OUT "finished"
+`
+	vm, out := loadSource(t, stale)
+	vm.Run()
+	if got, want := out.String(), "finished\n"; got != want {
+		t.Errorf("RESUME of a finished generator's id printed %q, want %q", got, want)
+	}
+	if gen := vm.generators[2]; gen == nil || gen.cursor != vm.functions["one"].line {
+		t.Errorf("the second generator ran on RESUME of the first one's id")
+	}
+}
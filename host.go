@@ -0,0 +1,192 @@
+package twist
+
+import (
+	"fmt"
+)
+
+// HostFunc is a Go function scripts can CALL. It gets the arguments popped off the argument stack
+// and its results are pushed back onto it, the same way a DEF function returns with ADDARG
+type HostFunc func(args []Value) ([]Value, error)
+
+type hostFunction struct {
+	arity int
+	fn    HostFunc
+}
+
+// RegisterFunc makes fn callable as CALL "name". CALL "name" % pops arity arguments, an explicit
+// count pops that many instead. An error from fn is thrown as HOST_FUNCTION_ERROR, which ERRH can handle.
+// A DEF with the same name in the program takes precedence
+func (vm *VM) RegisterFunc(name string, arity int, fn func(args []Value) ([]Value, error)) {
+	if vm.hosts == nil {
+		vm.hosts = make(map[string]hostFunction)
+	}
+	vm.hosts[name] = hostFunction{arity: arity, fn: fn}
+}
+
+// callHost runs the host function name for a CALL, it returns false if there is no host function by that name
+func (vm *VM) callHost(name string, inst *Instruction) bool {
+	host, found := vm.hosts[name]
+	if !found {
+		return false
+	}
+	count := 0
+	if inst.Argument > 0 {
+		count = inst.Argument
+	} else if inst.Args {
+		count = host.arity
+	}
+	popped_args, ok := vm.popArgs(count, inst)
+	if !ok {
+		return true
+	}
+
+	results, err := host.call(append([]Value(nil), popped_args...))
+	if err != nil {
+		vm.throwError(fmt.Sprintf("%s '%s': %v", HOST_FUNCTION_ERROR, name, err), inst)
+		return true
+	}
+	vm.args = append(vm.args, results...)
+	// come back where a DEF function's RET would, past the instruction after the CALL
+	vm.C.cursor++
+	return true
+}
+
+// call runs the function, turning a panic into an error so a bug in Go code can be handled like one in the script
+func (host hostFunction) call(args []Value) (results []Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return host.fn(args)
+}
+
+// toValue converts a Go value to one the VM can hold, any integer type becomes an int, a []interface{} a wheel
+// and a map[string]interface{} a map
+func toValue(v interface{}) (Value, error) {
+	switch v := v.(type) {
+	case Value:
+		return v, nil
+	case int:
+		return IntValue(v), nil
+	case int8:
+		return IntValue(int(v)), nil
+	case int16:
+		return IntValue(int(v)), nil
+	case int32:
+		return IntValue(int(v)), nil
+	case int64:
+		return IntValue(int(v)), nil
+	case uint8:
+		return IntValue(int(v)), nil
+	case uint16:
+		return IntValue(int(v)), nil
+	case uint32:
+		return IntValue(int(v)), nil
+	case float32:
+		return FloatValue(float64(v)), nil
+	case float64:
+		return FloatValue(v), nil
+	case string:
+		return StringValue(v), nil
+	case bool:
+		// CMP 0 tells them apart
+		if v {
+			return IntValue(1), nil
+		}
+		return IntValue(0), nil
+	case []interface{}:
+		items, err := toValues(v)
+		if err != nil {
+			return Value{}, err
+		}
+		return WheelValue(items...), nil
+	case map[string]interface{}:
+		entries := make(map[Value]Value, len(v))
+		for key, item := range v {
+			value, err := toValue(item)
+			if err != nil {
+				return Value{}, err
+			}
+			entries[StringValue(key)] = value
+		}
+		return MapValue(entries), nil
+	}
+	return Value{}, fmt.Errorf("%T can't be stored in a VWheel", v)
+}
+
+func toValues(values []interface{}) ([]Value, error) {
+	converted := make([]Value, len(values))
+	for i, v := range values {
+		value, err := toValue(v)
+		if err != nil {
+			return nil, err
+		}
+		converted[i] = value
+	}
+	return converted, nil
+}
+
+// Call runs a single function of the program with args converted to Values, without running the
+// rest of it. It starts at the function's line with a fresh VWheel holding args, like CALL "name" with
+// len(args), and stops when that frame's RET executes. What the function left on the argument stack
+// is returned as Go values, see Value.Interface. A runtime error is returned instead of being printed
+// and panicking, and the VM is left as it was, so a library can be loaded once and its functions called again and again
+func (vm *VM) Call(name string, args ...interface{}) (results []interface{}, err error) {
+	values, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+	fn, found := vm.functions[name]
+	if !found {
+		if host, found := vm.hosts[name]; found {
+			returned, err := host.call(values)
+			if err != nil {
+				return nil, err
+			}
+			return plainValues(returned), nil
+		}
+		return nil, fmt.Errorf("%s '%s'", UNDEFINED_FUNCTION_ERROR, name)
+	}
+
+	cursor, depth, calls, saved, quiet := vm.C.cursor, len(vm.dataStack), len(vm.callStack), vm.args, vm.quiet
+	vm.quiet = true
+	if vm.profiler != nil {
+		defer vm.profiler.stop()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			results = nil
+			if rerr, ok := r.(error); ok {
+				err = rerr
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+		vm.C.cursor = cursor
+		vm.dataStack = vm.dataStack[:depth]
+		vm.callStack = vm.callStack[:calls]
+		vm.args = saved
+		vm.quiet = quiet
+	}()
+
+	vm.args = nil
+	// the return address a CALL at the cursor would push, the profiler takes the address before it as the caller
+	vm.callStack = append(vm.callStack, cursor+1)
+	vm.dataStack = append(vm.dataStack, VWheel{dir: 1, data: values})
+	vm.C.cursor = fn.line
+	for len(vm.callStack) > calls {
+		if !vm.Step() {
+			return nil, fmt.Errorf("'%s' ran off the end of the program without returning", name)
+		}
+	}
+	return plainValues(vm.args), nil
+}
+
+func plainValues(values []Value) []interface{} {
+	plain := make([]interface{}, len(values))
+	for i, v := range values {
+		plain[i] = v.Interface()
+	}
+	return plain
+}
@@ -0,0 +1,145 @@
+package twist
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Flow tells Step what to do after an instruction's handler ran
+type Flow int
+
+const (
+	Next    Flow = iota // move the CWheel cursor on to the next instruction
+	Jumped              // the handler moved the CWheel cursor itself
+	Halt                // the program has ended
+	Blocked             // the instruction has to wait for another thread, Step runs it again once something changes
+)
+
+// Shape is the operands an instruction is written with, the Operand flags combined,
+// so `CALL "name" 2` is OperandString|OperandInt and a bare `RET` is 0
+type Shape int
+
+const (
+	OperandInt    Shape = 1 << iota // a whole number, Instruction.Argument
+	OperandFloat                    // a decimal number, Instruction.ArgumentF
+	OperandString                   // a quoted string, Instruction.ArgumentStr
+	OperandArgs                     // %, Instruction.Args
+	OperandAlias                    // as name, Instruction.Alias
+)
+
+// InstructionHandler runs an instruction. It gets the VM, the current VWheel, the argument stack
+// and the instruction with its decoded operands, which points into the program and mustn't be changed.
+// Errors are thrown with vm.Throw like the built-ins do
+type InstructionHandler func(vm *VM, wheel *VWheel, args *[]Value, inst *Instruction) Flow
+
+// Throw raises an error from an instruction handler. An ERRH after the instruction moves the CWheel cursor,
+// otherwise the program stops with a *RuntimeError. Either way the handler should return Next straight after
+func (vm *VM) Throw(message string, inst *Instruction) {
+	vm.throwError(message, inst)
+}
+
+// Current is the value under the wheel's cursor, ok is false if the wheel is empty
+func (w *VWheel) Current() (v Value, ok bool) {
+	if len(w.data) == 0 {
+		return Value{}, false
+	}
+	return w.data[w.cursor], true
+}
+
+// SetCurrent replaces the value under the cursor, an empty wheel gets it as its first value
+func (w *VWheel) SetCurrent(v Value) {
+	if len(w.data) == 0 {
+		w.data = append(w.data, v)
+		return
+	}
+	w.data[w.cursor] = v
+}
+
+// Push adds v after the last value, where results like LEN's go
+func (w *VWheel) Push(v Value) {
+	w.data = append(w.data, v)
+}
+
+// InstructionDef describes an instruction: what it does (shown on hover and in completions),
+// the operand shapes the parser and checker accept, and how it runs. A nil Handler does nothing at runtime
+type InstructionDef struct {
+	Name      string
+	Signature string
+	Doc       string
+	Shapes    []Shape
+	Handler   InstructionHandler
+}
+
+// instructionSet holds every instruction in the order of the readme, followed by registered ones.
+// instructionIndex finds them by name for Step
+var (
+	instructionSet   []*InstructionDef
+	instructionIndex = make(map[string]*InstructionDef)
+)
+
+func init() {
+	for i := range builtins {
+		instructionSet = append(instructionSet, &builtins[i])
+		instructionIndex[builtins[i].Name] = &builtins[i]
+	}
+}
+
+// RegisterInstruction adds a new mnemonic, which from then on parses, passes the checker and runs like a built-in.
+// Names are upper case like the built-ins, and an instruction can't be registered twice
+func RegisterInstruction(def InstructionDef) error {
+	if def.Name == "" || def.Name != strings.ToUpper(def.Name) || strings.ContainsAny(def.Name, " \t\"%;") {
+		return fmt.Errorf("bad instruction name %q", def.Name)
+	}
+	if _, exists := lookupMnemonic(def.Name); exists {
+		return fmt.Errorf("instruction %s is already defined", def.Name)
+	}
+	if def.Signature == "" {
+		def.Signature = def.Name
+	}
+	instructionSet = append(instructionSet, &def)
+	instructionIndex[def.Name] = &def
+	return nil
+}
+
+func lookupMnemonic(name string) (*InstructionDef, bool) {
+	def, found := instructionIndex[name]
+	return def, found
+}
+
+// accepts reports whether an instruction written with the operands in shape is valid.
+// Once parsed, a zero int can't be told apart from a missing one, so when checking an Instruction
+// (rather than source) the int counts as optional
+func (def *InstructionDef) accepts(shape Shape, intOptional bool) bool {
+	for _, allowed := range def.Shapes {
+		if shape == allowed || (intOptional && shape|OperandInt == allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// shapeOf is the shape of a parsed instruction, a zero int is left out
+func shapeOf(inst Instruction) Shape {
+	var shape Shape
+	if inst.Argument != 0 {
+		shape |= OperandInt
+	}
+	if inst.ArgumentF != 0 {
+		shape |= OperandFloat
+	}
+	if inst.ArgumentStr != "" {
+		shape |= OperandString
+	}
+	if inst.Args {
+		shape |= OperandArgs
+	}
+	if inst.Alias != "" {
+		shape |= OperandAlias
+	}
+	return shape
+}
+
+// operandError describes operands an instruction doesn't take
+func (def *InstructionDef) operandError() string {
+	return fmt.Sprintf("bad operands for %s, expected %s", def.Name, def.Signature)
+}
@@ -1,386 +1,714 @@
-package main
+package twist
 
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 type Instruction struct {
-	Mnemonic    string
-	Argument    int
-	ArgumentF   float64
-	ArgumentStr string
-	Args        bool
+	Mnemonic    string  `json:"mnemonic"`
+	Argument    int     `json:"argument,omitempty"`
+	ArgumentF   float64 `json:"argument_f,omitempty"`
+	ArgumentStr string  `json:"argument_str,omitempty"`
+	Args        bool    `json:"args,omitempty"`
+	Alias       string  `json:"alias,omitempty"`
+	Line        int     `json:"line"`
+	// File is the module an instruction was imported from, empty for the program itself
+	File string `json:"file,omitempty"`
 }
 
 // test
 type VWheel struct {
 	cursor  int
-	data    []interface{}
+	data    []Value
 	dir     int
 	CMPFLAG bool
+	// active is the named wheel this frame selected with USE, empty for the frame itself
+	active string
+	// entered is the path of cells this frame went into with ENTER, starting from the wheel it is using, see nested.go
+	entered []int
+	// generator is the id of the generator this frame belongs to, 0 for a CALL
+	generator int
 }
 
 type CWheel struct {
 	cursor int
 	data   []Instruction
-	dir    int
+	// code is data decoded, see decode.go
+	code []op
+	dir  int
 }
 type VM struct {
 	dataStack []VWheel
 	C         CWheel
 	callStack []int
+	args      []Value
+	functions map[string]function
+	hosts     map[string]hostFunction
+	named     map[string]*VWheel
+	// generators are the frames GEN set up, suspended between RESUMEs, a finished one is deleted.
+	// lastGenerator is the last id GEN handed out, ids are never given out twice
+	generators    map[int]*generator
+	lastGenerator int
+	// programEnd is where the program's own instructions stop and IMPORTed modules start
+	programEnd int
+
+	stdin    *bufio.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	session  *Session
+	clock    Clock
+	profiler *Profiler
+	coverage *Coverage
+
+	// halt asks Run to stop before the next instruction, paused records that it did
+	halt   atomic.Bool
+	paused bool
+
+	// group is shared by every thread SPAWNed from the program, id is this one's place in it (0 for the program itself)
+	group    *threadGroup
+	id       int
+	finished bool
+	waiting  bool
+	outbox   *parcel
+
+	// quiet keeps an unhandled error from being printed, Call returns it instead
+	quiet bool
+
+	// out is reused to build what OUT, ARGVIEW and DBGPRINTV print, so printing a value doesn't allocate
+	out []byte
+}
+
+func NewVM(instructions []Instruction) *VM {
+	functions := collectFunctions(instructions)
+	vm := &VM{
+		C: CWheel{
+			data: instructions,
+			code: decodeProgram(instructions, functions),
+		},
+		// Initialize the VM with a global scope (one VWheel on the dataStack).
+		dataStack:  []VWheel{{dir: 1}},
+		functions:  functions,
+		named:      make(map[string]*VWheel),
+		programEnd: programLength(instructions),
+		stdin:      bufio.NewReader(os.Stdin),
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+		clock:      NewRealClock(),
+	}
+	vm.group = newThreadGroup(vm)
+	return vm
+}
+
+// readLine reads a line for INP, from the session being replayed if there is one
+func (vm *VM) readLine() (string, error) {
+	if vm.session != nil && vm.session.replaying {
+		return vm.session.input()
+	}
+	var line string
+	var err error
+	vm.unlocked(func() { line, err = vm.stdin.ReadString('\n') })
+	if vm.session != nil {
+		vm.session.recordInput(line)
+	}
+	return line, err
+}
+
+// delay sleeps for DEL on the VM's clock
+func (vm *VM) delay(d time.Duration) {
+	if vm.session != nil {
+		vm.session.delay(d)
+	}
+	vm.unlocked(func() { vm.clock.Sleep(d) })
+}
+
+// elapsed is the virtual time TIME reads
+func (vm *VM) elapsed() time.Duration {
+	d := vm.clock.Elapsed()
+	if vm.session != nil {
+		d = vm.session.elapsed(d)
+	}
+	return d
+}
+
+// Stop pauses Run before the next instruction. It is safe to call from another goroutine,
+// and the VM can be snapshotted or resumed with Run afterwards
+func (vm *VM) Stop() {
+	vm.halt.Store(true)
+}
+
+// Paused reports whether the last Run returned because of Stop rather than the program ending
+func (vm *VM) Paused() bool {
+	return vm.paused
+}
+
+// Program is the CWheel, the program and every module linked into it
+func (vm *VM) Program() []Instruction {
+	return vm.C.data
+}
+
+// SetOutput sends what OUT prints to stdout and what OUT "string" prints to stderr, os.Stdout and os.Stderr by default
+func (vm *VM) SetOutput(stdout, stderr io.Writer) {
+	vm.stdout = stdout
+	vm.stderr = stderr
+}
+
+// SetClock picks what DEL sleeps on and TIME reads, a RealClock by default
+func (vm *VM) SetClock(clock Clock) {
+	vm.clock = clock
+}
+
+// SetProfiler records a profile of the run into p
+func (vm *VM) SetProfiler(p *Profiler) {
+	vm.profiler = p
+}
+
+// SetCoverage records which instructions run, and which way every JIZ goes, into c
+func (vm *VM) SetCoverage(c *Coverage) {
+	vm.coverage = c
+}
+
+// programLength counts the instructions before the first one linked in from a module
+func programLength(instructions []Instruction) int {
+	for i, inst := range instructions {
+		if inst.File != "" {
+			return i
+		}
+	}
+	return len(instructions)
 }
 
 func mod(a, b int) int {
 	return (a%b + b) % b
 }
 
+// jumpTarget is where the CWheel cursor lands after moving steps from cursor.
+// Anything but a direction of 1 moves backwards, so with the default direction negative steps go forward
+func jumpTarget(cursor, steps, dir, n int) int {
+	if dir == 1 {
+		return mod(cursor+steps, n)
+	}
+	return mod(cursor-steps, n)
+}
+
 type function struct {
 	argument_count int
 	line           int
 }
 
 func (vm *VM) Run() {
-	functions := make(map[string]function)
-	var args []interface{}
-
-	for i, inst := range vm.C.data {
-		if inst.Mnemonic == "DEF" {
-			functions[inst.ArgumentStr] = function{
-				line:           i + 1,
-				argument_count: inst.Argument, //for now...
-			}
-		}
+	vm.paused = false
+
+	if vm.profiler != nil {
+		defer vm.profiler.stop()
 	}
 
-	if len(vm.dataStack) > 0 {
-		vm.dataStack[0].dir = 1
+	// spawned threads stop with the program, unless it was only paused
+	defer func() {
+		if !vm.paused {
+			vm.group.end()
+		}
+	}()
+
+	if vm.group.scheduler != nil {
+		vm.runScheduled()
+		return
 	}
 
 	for vm.C.cursor < len(vm.C.data) {
-		inst := vm.C.data[vm.C.cursor]
-		currentVWheel := &vm.dataStack[len(vm.dataStack)-1]
-		switch inst.Mnemonic {
-		case "DEL":
-			if inst.Args {
-				numericArgs, err := getNumericArgs(&args, 1)
-				if err != nil {
-					vm.throwError(fmt.Sprintf("%s: %v", ARITHMETIC_ERROR, err), &inst)
-				}
-				if len(numericArgs) == 0 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				delay := numericArgs[0]
-				if delay < 0 {
-					delay = 0
-				}
-				time.Sleep(time.Duration(delay) * time.Millisecond)
-			} else {
-				time.Sleep(time.Duration(inst.Argument) * time.Millisecond)
-			}
-		case "DEF":
-			searchCursor := vm.C.cursor + 1
-			for searchCursor < len(vm.C.data) && vm.C.data[searchCursor].Mnemonic != "RET" {
-				searchCursor++
-			}
-			if searchCursor == len(vm.C.data) {
-				vm.throwError(INCORRECT_TERMINATION_ERROR, &inst)
+		if vm.halt.Load() {
+			vm.halt.Store(false)
+			vm.paused = true
+			return
+		}
+		if !vm.Step() {
+			return
+		}
+	}
+}
+
+// Step executes the instruction under the CWheel cursor, it returns false once the program has ended
+func (vm *VM) Step() bool {
+	vm.group.mu.Lock()
+	defer vm.group.mu.Unlock()
+	if vm.interrupted() {
+		return false
+	}
+	if vm.C.cursor >= len(vm.C.data) {
+		return false
+	}
+	if vm.profiler != nil {
+		vm.profiler.step(vm)
+	}
+	if vm.coverage != nil {
+		vm.coverage.hit(vm.C.cursor)
+	}
+	inst := &vm.C.data[vm.C.cursor]
+	code := vm.op()
+	currentVWheel := vm.wheel()
+	if code.handler != nil {
+		flow := code.handler(vm, currentVWheel, &vm.args, inst)
+		// SEND, RECV and JOIN wait for another thread, then get another go
+		for flow == Blocked {
+			if !vm.wait(inst) {
+				flow = Next
+				break
 			}
-			vm.C.cursor = searchCursor
-		case "ARGVIEW":
-			for _, item := range args {
-				fmt.Printf("%v ", item)
+			// the scheduler comes back to the same instruction once the thread is woken
+			if vm.group.scheduler != nil {
+				return true
 			}
-			println("\n")
-		case "JMP":
-			moveSteps := inst.Argument
-			if vm.C.dir == 1 {
-				vm.C.cursor = mod(vm.C.cursor+moveSteps, len(vm.C.data))
-			} else {
-				vm.C.cursor = mod(vm.C.cursor-moveSteps, len(vm.C.data))
+			if vm.interrupted() {
+				return false
 			}
-			//println(vm.C.data[vm.C.cursor].Mnemonic)
-			continue
+			flow = code.handler(vm, vm.wheel(), &vm.args, inst)
+		}
+		switch flow {
+		case Jumped:
+			return true
+		case Halt:
+			return false
+		}
+	}
 
-		case "CALL":
-			funcName := inst.ArgumentStr
-			if startAddr, found := functions[funcName]; found {
-				vm.callStack = append(vm.callStack, vm.C.cursor+1)
-				var popped_args []interface{}
-				if inst.Argument > 0 {
-					popped_args, args = pop_args_and_return(inst.Argument, args)
-				} else if inst.Args {
-					popped_args, args = pop_args_and_return(functions[funcName].argument_count, args)
-				}
-				newVWheel := VWheel{
-					dir:  1,
-					data: popped_args,
-				}
+	vm.C.cursor++
+	// running off the end of the program (or returning from a CALL on its last line) ends it,
+	// the modules linked in after it only run when called
+	if vm.C.cursor == vm.programEnd || (code.returns && vm.C.cursor == vm.programEnd+1) {
+		vm.C.cursor = len(vm.C.data)
+	}
+	return true
+}
 
-				vm.dataStack = append(vm.dataStack, newVWheel)
-				vm.C.cursor = startAddr.line
-				continue
-			} else {
-				vm.throwError(fmt.Sprintf("%s '%s'", UNDEFINED_FUNCTION_ERROR, funcName), &inst)
-			}
-		case "RET":
-			if len(vm.callStack) > 0 {
-				// Pop the function's VWheel if it's not the last one
-				if len(vm.dataStack) > 1 {
-					vm.dataStack = vm.dataStack[:len(vm.dataStack)-1]
-				}
+// The built-in instructions, registered in docs.go. Each runs with the instruction under the CWheel cursor
 
-				returnAddr := vm.callStack[len(vm.callStack)-1]
-				vm.callStack = vm.callStack[:len(vm.callStack)-1]
-				vm.C.cursor = returnAddr
-			} else {
-				os.Exit(0)
-			}
-		case "NEWV":
-			if len(inst.ArgumentStr) > 0 {
-				currentVWheel.data = append(currentVWheel.data, inst.ArgumentStr)
-			} else {
-				currentVWheel.data = append(currentVWheel.data, inst.Argument)
-			}
-		case "WHLDIRV":
-			if inst.Argument != 1 && inst.Argument != -1 {
-				vm.throwError(BAD_ARGUMENT_ERROR, &inst)
-			}
-			currentVWheel.dir = inst.Argument
-		case "WHLDIRC":
-			if inst.Argument != 1 && inst.Argument != -1 {
-				vm.throwError(BAD_ARGUMENT_ERROR, &inst)
-			}
-			vm.C.dir = inst.Argument
-		case "ADDARG":
-			args = append(args, currentVWheel.data[currentVWheel.cursor])
-		case "CMP":
-			if inst.Args {
-				var popped_args []interface{}
-				popped_args, _ = pop_args_and_return(1, args)
-				cursor_data := currentVWheel.data[currentVWheel.cursor]
-				switch cursor_data.(type) {
-				case int:
-					currentVWheel.CMPFLAG = cursor_data.(int) > popped_args[0].(int)
-				case string:
-					currentVWheel.CMPFLAG = cursor_data.(string) == popped_args[0].(string)
-				}
-			} else {
-				cursor_data := currentVWheel.data[currentVWheel.cursor]
-				if len(inst.ArgumentStr) > 0 {
-					switch val := cursor_data.(type) {
-					case int:
-						currentVWheel.CMPFLAG = strconv.Itoa(val) == inst.ArgumentStr
-					case string:
-						currentVWheel.CMPFLAG = val == inst.ArgumentStr
-					default:
-						currentVWheel.CMPFLAG = false
-					}
-				} else {
-					currentVWheel.CMPFLAG = cursor_data.(int) > inst.Argument
-				}
-			}
+func (vm *VM) opDEL(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Args {
+		numericArgs, ok := vm.numericArgs(1, inst)
+		if !ok {
+			return Next
+		}
+		delay, _ := numericArgs[0].Float()
+		if delay < 0 {
+			delay = 0
+		}
+		vm.delay(time.Duration(delay * float64(time.Millisecond)))
+	} else {
+		vm.delay(time.Duration(inst.Argument) * time.Millisecond)
+	}
+	return Next
+}
 
-		case "OUT":
-			if len(inst.ArgumentStr) > 0 {
-				println(inst.ArgumentStr)
-			} else {
-				fmt.Printf("%v \n", currentVWheel.data[currentVWheel.cursor])
-			}
-		case "INP":
-			if len(inst.ArgumentStr) > 0 {
-				fmt.Println(inst.ArgumentStr)
-			}
-			reader := bufio.NewReader(os.Stdin)
-			input, _ := reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-			if val, err := strconv.Atoi(input); err == nil {
-				currentVWheel.data[currentVWheel.cursor] = val
-			} else {
-				currentVWheel.data[currentVWheel.cursor] = input
-			}
-		case "MOVVW":
-			moveSteps := inst.Argument
-			if len(currentVWheel.data) == 0 {
-				vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-			}
-			if currentVWheel.dir == 1 {
-				currentVWheel.cursor = mod(currentVWheel.cursor+moveSteps, len(currentVWheel.data))
-			} else {
-				currentVWheel.cursor = mod(currentVWheel.cursor-moveSteps, len(currentVWheel.data))
-			}
-		case "JIZ":
-			if !currentVWheel.CMPFLAG {
-				moveSteps := inst.Argument
-				if vm.C.dir == 1 {
-					vm.C.cursor = mod(vm.C.cursor+moveSteps, len(vm.C.data))
-				} else {
-					vm.C.cursor = mod(vm.C.cursor-moveSteps, len(vm.C.data))
-				}
-				//println(vm.C.data[vm.C.cursor].Mnemonic)
-				continue
-			}
-		case "DBGPRINTV":
-			vm.printDebug()
-		case "ADD":
-			if inst.Args {
-				numArgs := inst.Argument
-				numericArgs, err := getNumericArgs(&args, numArgs)
-				if err != nil {
-					vm.throwError(fmt.Sprintf("%s: %v", ARITHMETIC_ERROR, err), &inst)
-				}
-				result := 0
-				for _, val := range numericArgs {
-					result += val
-				}
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
+func (vm *VM) opTIME(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	currentVWheel.data = append(currentVWheel.data, IntValue(int(vm.elapsed().Milliseconds())))
+	return Next
+}
 
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else if inst.Argument != 0 {
-				result := inst.Argument + currentVWheel.data[currentVWheel.cursor].(int)
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else {
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
-				result := 0
-				for _, item := range currentVWheel.data {
-					if val, ok := item.(int); ok {
-						result += val
-					} else {
-						vm.throwError(NUMERIC_DATA_ERROR, &inst)
-					}
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			}
-		case "SUB":
-			if inst.Argument > 0 {
-				numArgs := inst.Argument
-				numericArgs, err := getNumericArgs(&args, numArgs)
-				if err != nil {
-					vm.throwError(fmt.Sprintf("%s: %v", ARITHMETIC_ERROR, err), &inst)
-				}
-				if len(numericArgs) == 0 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				result := numericArgs[0]
-				for i := 1; i < len(numericArgs); i++ {
-					result -= numericArgs[i]
-				}
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else {
-				if len(currentVWheel.data) < 1 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				var numericData []int
-				for _, item := range currentVWheel.data {
-					if val, ok := item.(int); ok {
-						numericData = append(numericData, val)
-					} else {
-						vm.throwError(NUMERIC_DATA_ERROR, &inst)
-					}
-				}
-				result := numericData[0]
-				for i := 1; i < len(numericData); i++ {
-					result -= numericData[i]
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			}
-		case "MUL":
-			if inst.Args {
-				numArgs := inst.Argument
-				numericArgs, err := getNumericArgs(&args, numArgs)
-				if err != nil {
-					vm.throwError(fmt.Sprintf("%s: %v", ARITHMETIC_ERROR, err), &inst)
-				}
-				if len(numericArgs) == 0 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				result := 1
-				for _, val := range numericArgs {
-					result *= val
-				}
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else if inst.Argument > 0 {
-				result := inst.Argument * currentVWheel.data[currentVWheel.cursor].(int)
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else {
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
-				result := 1
-				for _, item := range currentVWheel.data {
-					if val, ok := item.(int); ok {
-						result *= val
-					} else {
-						vm.throwError(NUMERIC_DATA_ERROR, &inst)
-					}
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			}
-		case "DIV":
-			if inst.Argument > 0 {
-				numArgs := inst.Argument
-				numericArgs, err := getNumericArgs(&args, numArgs)
-				if err != nil {
-					vm.throwError(fmt.Sprintf("%s: %v", ARITHMETIC_ERROR, err), &inst)
-				}
-				if len(numericArgs) == 0 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				result := numericArgs[0]
-				for i := 1; i < len(numericArgs); i++ {
-					if numericArgs[i] == 0 {
-						vm.throwError(DIVISION_BY_ZERO_ERROR, &inst)
-					}
-					result /= numericArgs[i]
-				}
-				if len(currentVWheel.data) == 0 {
-					vm.throwError(EMPTY_VWHEEL_ERROR, &inst)
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			} else {
-				if len(currentVWheel.data) < 1 {
-					vm.throwError(NOT_ENOUGH_ARGS_ERROR, &inst)
-				}
-				var numericData []int
-				for _, item := range currentVWheel.data {
-					if val, ok := item.(int); ok {
-						numericData = append(numericData, val)
-					} else {
-						vm.throwError(NUMERIC_DATA_ERROR, &inst)
-					}
-				}
-				var result float64
-				result = float64(numericData[0])
-				for i := 1; i < len(numericData); i++ {
-					if numericData[i] == 0 {
-						vm.throwError(DIVISION_BY_ZERO_ERROR, &inst)
-					}
-					result /= float64(numericData[i])
-				}
-				currentVWheel.data[currentVWheel.cursor] = result
-			}
-		case "DBGPRINTC":
-			vm.printDebugC()
+func (vm *VM) opDEF(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	ret := vm.op().ret
+	if ret == len(vm.C.data) {
+		vm.throwError(INCORRECT_TERMINATION_ERROR, inst)
+	}
+	vm.C.cursor = ret
+	return Next
+}
+
+func (vm *VM) opARGVIEW(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.out = vm.out[:0]
+	for _, item := range vm.args {
+		vm.out = append(item.appendTo(vm.out), ' ')
+	}
+	vm.stdout.Write(vm.out)
+	io.WriteString(vm.stderr, "\n\n")
+	return Next
+}
+
+func (vm *VM) opJMP(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.C.cursor = vm.op().jump(vm.C.dir)
+	return Jumped
+}
+
+func (vm *VM) opCALL(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	funcName, ok := vm.callee(currentVWheel, inst)
+	if !ok {
+		return Next
+	}
+	if startAddr, found := vm.lookupFunction(funcName, inst); found {
+		popped_args, ok := vm.callArgs(startAddr, inst)
+		if !ok {
+			return Next
+		}
+		// copied, popped_args still shares its array with vm.args and ADDARG would write over the new wheel
+		if vm.tailCall() {
+			// nothing is left to run in this frame, the callee takes its place, and its array, and returns straight to our caller
+			frame := &vm.dataStack[len(vm.dataStack)-1]
+			*frame = VWheel{dir: 1, data: append(frame.data[:0], popped_args...)}
+		} else {
+			vm.callStack = append(vm.callStack, vm.C.cursor+1)
+			vm.dataStack = append(vm.dataStack, VWheel{dir: 1, data: append([]Value(nil), popped_args...)})
+		}
+		vm.C.cursor = startAddr.line
+		return Jumped
+	} else if !vm.callHost(funcName, inst) {
+		vm.throwError(fmt.Sprintf("%s '%s'", UNDEFINED_FUNCTION_ERROR, funcName), inst)
+	}
+	return Next
+}
+
+// tailCall reports whether the CALL under the cursor returns onto a RET inside a function, so the frame
+// can be reused and tail recursion runs in constant space.
+// The top level and generators keep their frame, RET means something else there
+func (vm *VM) tailCall() bool {
+	return vm.op().tail && len(vm.callStack) > 0 && vm.dataStack[len(vm.dataStack)-1].generator == 0
+}
+
+func (vm *VM) opRET(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if id := vm.dataStack[len(vm.dataStack)-1].generator; id != 0 {
+		vm.finishGenerator(id)
+		return Next
+	}
+	if len(vm.callStack) > 0 {
+		// Pop the function's VWheel if it's not the last one
+		if len(vm.dataStack) > 1 {
+			vm.dataStack = vm.dataStack[:len(vm.dataStack)-1]
+		}
+
+		returnAddr := vm.callStack[len(vm.callStack)-1]
+		vm.callStack = vm.callStack[:len(vm.callStack)-1]
+		vm.C.cursor = returnAddr
+	} else {
+		return Halt
+	}
+	return Next
+}
+
+func (vm *VM) opNEWV(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(inst.ArgumentStr) > 0 {
+		currentVWheel.data = append(currentVWheel.data, StringValue(inst.ArgumentStr))
+	} else {
+		currentVWheel.data = append(currentVWheel.data, IntValue(inst.Argument))
+	}
+	return Next
+}
+
+func (vm *VM) opWHLDIRV(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Argument != 1 && inst.Argument != -1 {
+		vm.throwError(BAD_ARGUMENT_ERROR, inst)
+	}
+	currentVWheel.dir = inst.Argument
+	return Next
+}
+
+func (vm *VM) opWHLDIRC(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Argument != 1 && inst.Argument != -1 {
+		vm.throwError(BAD_ARGUMENT_ERROR, inst)
+	}
+	vm.C.dir = inst.Argument
+	return Next
+}
+
+func (vm *VM) opADDARG(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.args = append(vm.args, currentVWheel.data[currentVWheel.cursor])
+	return Next
+}
+
+func (vm *VM) opCMP(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	cursor_data := currentVWheel.data[currentVWheel.cursor]
+	if inst.Args {
+		front, ok := vm.frontArg(inst)
+		if !ok {
+			return Next
+		}
+		if cursor_data.Kind() == KindString {
+			currentVWheel.CMPFLAG = cursor_data.Equal(front)
+		} else if greater, ok := cursor_data.Greater(front); ok {
+			currentVWheel.CMPFLAG = greater
+		} else {
+			vm.throwError(NUMERIC_DATA_ERROR, inst)
+		}
+	} else if len(inst.ArgumentStr) > 0 {
+		switch cursor_data.Kind() {
+		case KindInt, KindString:
+			currentVWheel.CMPFLAG = cursor_data.String() == inst.ArgumentStr
+		default:
+			currentVWheel.CMPFLAG = false
+		}
+	} else if greater, ok := cursor_data.Greater(IntValue(inst.Argument)); ok {
+		currentVWheel.CMPFLAG = greater
+	} else {
+		vm.throwError(NUMERIC_DATA_ERROR, inst)
+	}
+	return Next
+}
+
+func (vm *VM) opOUT(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(inst.ArgumentStr) > 0 {
+		vm.out = append(append(vm.out[:0], inst.ArgumentStr...), '\n')
+		vm.stderr.Write(vm.out)
+	} else {
+		vm.out = append(currentVWheel.data[currentVWheel.cursor].appendTo(vm.out[:0]), " \n"...)
+		vm.stdout.Write(vm.out)
+	}
+	return Next
+}
+
+func (vm *VM) opINP(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(inst.ArgumentStr) > 0 {
+		fmt.Fprintln(vm.stdout, inst.ArgumentStr)
+	}
+	input, _ := vm.readLine()
+	input = strings.TrimSpace(input)
+	if val, err := strconv.Atoi(input); err == nil {
+		currentVWheel.data[currentVWheel.cursor] = IntValue(val)
+	} else {
+		currentVWheel.data[currentVWheel.cursor] = StringValue(input)
+	}
+	return Next
+}
+
+func (vm *VM) opMOVVW(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	moveSteps := inst.Argument
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+	}
+	if currentVWheel.dir == 1 {
+		currentVWheel.cursor = mod(currentVWheel.cursor+moveSteps, len(currentVWheel.data))
+	} else {
+		currentVWheel.cursor = mod(currentVWheel.cursor-moveSteps, len(currentVWheel.data))
+	}
+	return Next
+}
+
+func (vm *VM) opJIZ(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if vm.coverage != nil {
+		vm.coverage.branch(vm.C.cursor, !currentVWheel.CMPFLAG)
+	}
+	if !currentVWheel.CMPFLAG {
+		vm.C.cursor = vm.op().jump(vm.C.dir)
+		return Jumped
+	}
+	return Next
+}
+
+func (vm *VM) opDBGPRINTV(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.printDebug()
+	return Next
+}
+
+func (vm *VM) opADD(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Args {
+		numericArgs, ok := vm.numericArgs(inst.Argument, inst)
+		if !ok {
+			return Next
+		}
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(IntValue(0), numericArgs, Value.Add)
+	} else if inst.Argument != 0 {
+		vm.applyToCursor(currentVWheel, inst, Value.Add)
+	} else {
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		if !vm.numericWheel(currentVWheel, inst) {
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(IntValue(0), currentVWheel.data, Value.Add)
+	}
+	return Next
+}
+
+func (vm *VM) opSUB(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Argument > 0 {
+		numericArgs, ok := vm.numericArgs(inst.Argument, inst)
+		if !ok {
+			return Next
+		}
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(numericArgs[0], numericArgs[1:], Value.Sub)
+	} else {
+		if len(currentVWheel.data) < 1 {
+			vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+			return Next
+		}
+		if !vm.numericWheel(currentVWheel, inst) {
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(currentVWheel.data[0], currentVWheel.data[1:], Value.Sub)
+	}
+	return Next
+}
+
+func (vm *VM) opMUL(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if inst.Args {
+		numericArgs, ok := vm.numericArgs(inst.Argument, inst)
+		if !ok {
+			return Next
+		}
+		if len(numericArgs) == 0 {
+			vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+			return Next
+		}
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(IntValue(1), numericArgs, Value.Mul)
+	} else if inst.Argument > 0 {
+		vm.applyToCursor(currentVWheel, inst, Value.Mul)
+	} else {
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		if !vm.numericWheel(currentVWheel, inst) {
+			return Next
+		}
+		currentVWheel.data[currentVWheel.cursor] = fold(IntValue(1), currentVWheel.data, Value.Mul)
+	}
+	return Next
+}
+
+func (vm *VM) opDIV(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	var dividend Value
+	var divisors []Value
+	if inst.Argument > 0 {
+		numericArgs, ok := vm.numericArgs(inst.Argument, inst)
+		if !ok {
+			return Next
+		}
+		if len(currentVWheel.data) == 0 {
+			vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+			return Next
+		}
+		dividend, divisors = numericArgs[0], numericArgs[1:]
+	} else {
+		if len(currentVWheel.data) < 1 {
+			vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+			return Next
+		}
+		if !vm.numericWheel(currentVWheel, inst) {
+			return Next
 		}
+		// dividing the whole wheel always gives a float
+		first, _ := currentVWheel.data[0].Float()
+		dividend, divisors = FloatValue(first), currentVWheel.data[1:]
+	}
+	for _, divisor := range divisors {
+		if divisor.IsZero() {
+			vm.throwError(DIVISION_BY_ZERO_ERROR, inst)
+			return Next
+		}
+	}
+	currentVWheel.data[currentVWheel.cursor] = fold(dividend, divisors, Value.Div)
+	return Next
+}
+
+// fold combines start with every value in turn, they have all been checked to be numbers
+func fold(start Value, values []Value, operator func(Value, Value) (Value, bool)) Value {
+	result := start
+	for _, v := range values {
+		result, _ = operator(result, v)
+	}
+	return result
+}
+
+// applyToCursor combines the cursor value with the instruction's integer, like ADD 5
+func (vm *VM) applyToCursor(currentVWheel *VWheel, inst *Instruction, operator func(Value, Value) (Value, bool)) {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return
+	}
+	result, ok := operator(currentVWheel.data[currentVWheel.cursor], IntValue(inst.Argument))
+	if !ok {
+		vm.throwError(NUMERIC_DATA_ERROR, inst)
+		return
+	}
+	currentVWheel.data[currentVWheel.cursor] = result
+}
 
-		vm.C.cursor++
+// numericWheel checks every value in the wheel is a number before an instruction works on all of them,
+// throwing NUMERIC_DATA_ERROR if one isn't
+func (vm *VM) numericWheel(currentVWheel *VWheel, inst *Instruction) bool {
+	for _, item := range currentVWheel.data {
+		if !item.IsNumber() {
+			vm.throwError(NUMERIC_DATA_ERROR, inst)
+			return false
+		}
 	}
+	return true
+}
+
+func (vm *VM) opCAT(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	var result strings.Builder
+	if inst.Args {
+		popped_args, ok := vm.popArgs(inst.Argument, inst)
+		if !ok {
+			return Next
+		}
+		for _, item := range popped_args {
+			result.WriteString(item.String())
+		}
+	} else if len(inst.ArgumentStr) > 0 {
+		result.WriteString(currentVWheel.data[currentVWheel.cursor].String())
+		result.WriteString(inst.ArgumentStr)
+	} else {
+		for _, item := range currentVWheel.data {
+			result.WriteString(item.String())
+		}
+	}
+	currentVWheel.data[currentVWheel.cursor] = StringValue(result.String())
+	return Next
+}
+
+func (vm *VM) opLEN(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	cell := currentVWheel.data[currentVWheel.cursor]
+	if items, ok := cell.Items(); ok {
+		currentVWheel.data = append(currentVWheel.data, IntValue(len(items)))
+		return Next
+	}
+	if entries, ok := cell.Entries(); ok {
+		currentVWheel.data = append(currentVWheel.data, IntValue(len(entries)))
+		return Next
+	}
+	currentVWheel.data = append(currentVWheel.data, IntValue(utf8.RuneCountInString(cell.String())))
+	return Next
+}
+
+func (vm *VM) opSIZE(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	currentVWheel.data = append(currentVWheel.data, IntValue(len(currentVWheel.data)))
+	return Next
+}
+
+func (vm *VM) opDBGPRINTC(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	vm.printDebugC()
+	return Next
 }
 
 const (
@@ -392,8 +720,24 @@ const (
 	DIVISION_BY_ZERO_ERROR      = "Division by zero"
 	UNDEFINED_FUNCTION_ERROR    = "Call to undefined function"
 	ARITHMETIC_ERROR            = "Arithmetic error"
+	HOST_FUNCTION_ERROR         = "Host function error"
+	DEADLOCK_ERROR              = "Deadlock"
 )
 
+// errorNames maps the names ERRH takes to the messages thrown at runtime
+var errorNames = map[string]string{
+	"BAD_ARGUMENT_ERROR":          BAD_ARGUMENT_ERROR,
+	"INCORRECT_TERMINATION_ERROR": INCORRECT_TERMINATION_ERROR,
+	"EMPTY_VWHEEL_ERROR":          EMPTY_VWHEEL_ERROR,
+	"NUMERIC_DATA_ERROR":          NUMERIC_DATA_ERROR,
+	"NOT_ENOUGH_ARGS_ERROR":       NOT_ENOUGH_ARGS_ERROR,
+	"DIVISION_BY_ZERO_ERROR":      DIVISION_BY_ZERO_ERROR,
+	"UNDEFINED_FUNCTION_ERROR":    UNDEFINED_FUNCTION_ERROR,
+	"ARITHMETIC_ERROR":            ARITHMETIC_ERROR,
+	"HOST_FUNCTION_ERROR":         HOST_FUNCTION_ERROR,
+	"DEADLOCK_ERROR":              DEADLOCK_ERROR,
+}
+
 func (vm *VM) throwError(message string, inst *Instruction) {
 	nextInst := vm.C.data[vm.C.cursor+1]
 	if nextInst.Mnemonic == "ERRH" {
@@ -402,77 +746,41 @@ func (vm *VM) throwError(message string, inst *Instruction) {
 		//!! always fold this code or you will be blinded
 
 		if len(nextInst.ArgumentStr) > 0 {
-			arg := nextInst.ArgumentStr
-			switch arg {
-			//i apolgise for inflicting this code upon the world
-			case "BAD_ARGUMENT_ERROR":
-				if message == BAD_ARGUMENT_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "INCORRECT_TERMINATION_ERROR":
-				if message == INCORRECT_TERMINATION_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "EMPTY_VWHEEL_ERROR":
-				if message == EMPTY_VWHEEL_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "NUMERIC_DATA_ERROR":
-				if message == NUMERIC_DATA_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "NOT_ENOUGH_ARGS_ERROR":
-				if message == NOT_ENOUGH_ARGS_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "DIVISION_BY_ZERO_ERROR":
-				if message == DIVISION_BY_ZERO_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "UNDEFINED_FUNCTION_ERROR":
-				if message == UNDEFINED_FUNCTION_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			case "ARITHMETIC_ERROR":
-				if message == ARITHMETIC_ERROR {
-					moveSteps = nextInst.Argument
-				} else {
-					moveSteps = 0
-				}
-			default:
+			expected, found := errorNames[nextInst.ArgumentStr]
+			if !found {
 				panic("wtf bro :sob:")
 			}
+			// messages can carry details after the error, like the function name
+			if !strings.HasPrefix(message, expected) {
+				moveSteps = 0
+			}
 		}
-		if vm.C.dir == 1 {
-			vm.C.cursor = mod(vm.C.cursor+moveSteps, len(vm.C.data))
-		} else {
-			vm.C.cursor = mod(vm.C.cursor-moveSteps, len(vm.C.data))
-		}
+		vm.C.cursor = jumpTarget(vm.C.cursor, moveSteps, vm.C.dir, len(vm.C.data))
 	} else {
-		fmt.Printf("%s @ Line %d, instruction %s , argument %d", message, vm.C.cursor, inst.Mnemonic, inst.Argument)
-		panic("^")
+		err := &RuntimeError{Message: message, Index: vm.C.cursor, Instruction: *inst}
+		if !vm.quiet {
+			fmt.Fprint(vm.stdout, err)
+		}
+		panic(err)
 	}
 
 }
 
+// RuntimeError is what an unhandled error panics with, so code running the VM can recover it
+type RuntimeError struct {
+	Message     string
+	Index       int
+	Instruction Instruction
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("%s @ Line %d, instruction %s , argument %d", e.Message, e.Index, e.Instruction.Mnemonic, e.Instruction.Argument)
+}
+
 func (vm *VM) printDebugC() {
 	n := len(vm.C.data)
 	if n == 0 {
-		fmt.Println("no instructions")
+		fmt.Fprintln(vm.stdout, "no instructions")
 		return
 	}
 	radiusY := float64(n) * 0.8
@@ -540,15 +848,34 @@ func (vm *VM) printDebugC() {
 		}
 	}
 
-	for _, row := range canvas {
-		fmt.Println(string(row))
-	}
+	vm.writeCanvas(canvas)
 }
 
+// printDebug draws the wheel in use and then every wheel nested in its cells, each one once
 func (vm *VM) printDebug() {
-	n := len(vm.dataStack[len(vm.dataStack)-1].data)
+	wheel := vm.wheel()
+	drawn := map[*VWheel]bool{wheel: true}
+	vm.drawWheel(wheel)
+	vm.drawNested(wheel, "cell", drawn)
+}
+
+func (vm *VM) drawNested(wheel *VWheel, path string, drawn map[*VWheel]bool) {
+	for i, item := range wheel.data {
+		if item.kind != KindWheel || drawn[&item.p.wheel] {
+			continue
+		}
+		drawn[&item.p.wheel] = true
+		inner := fmt.Sprintf("%s %d", path, i)
+		fmt.Fprintf(vm.stdout, "%s:\n", inner)
+		vm.drawWheel(&item.p.wheel)
+		vm.drawNested(&item.p.wheel, inner, drawn)
+	}
+}
+
+func (vm *VM) drawWheel(wheel *VWheel) {
+	n := len(wheel.data)
 	if n == 0 {
-		fmt.Println("no variables")
+		fmt.Fprintln(vm.stdout, "no variables")
 		return
 	}
 	radiusY := float64(n) * 0.8
@@ -596,15 +923,15 @@ func (vm *VM) printDebug() {
 		}
 	}
 
-	for i, item := range vm.dataStack[len(vm.dataStack)-1].data {
+	for i, item := range wheel.data {
 		angle := float64(i) * angleStep
 
 		x := int(radiusX*math.Cos(angle) + centerX)
 		y := int(radiusY*math.Sin(angle) + centerY)
 
-		s := fmt.Sprintf("%v", item)
-		if i == vm.dataStack[len(vm.dataStack)-1].cursor {
-			s = fmt.Sprintf("[%v]", item)
+		s := item.String()
+		if i == wheel.cursor {
+			s = "[" + s + "]"
 		}
 
 		strLen := len(s)
@@ -616,33 +943,69 @@ func (vm *VM) printDebug() {
 		}
 	}
 
-	for _, row := range canvas {
-		fmt.Println(string(row))
+	vm.writeCanvas(canvas)
+	vm.out = append(vm.out[:0], '[')
+	for i, item := range wheel.data {
+		if i > 0 {
+			vm.out = append(vm.out, ' ')
+		}
+		vm.out = item.appendTo(vm.out)
 	}
-	fmt.Println(vm.dataStack[len(vm.dataStack)-1].data)
+	vm.out = append(vm.out, "]\n"...)
+	vm.stdout.Write(vm.out)
 }
 
-func pop_args_and_return(number int, args []interface{}) ([]interface{}, []interface{}) {
-	if len(args) < number {
+// writeCanvas prints a drawing a row at a time
+func (vm *VM) writeCanvas(canvas [][]rune) {
+	for _, row := range canvas {
+		vm.out = vm.out[:0]
+		for _, r := range row {
+			vm.out = utf8.AppendRune(vm.out, r)
+		}
+		vm.out = append(vm.out, '\n')
+		vm.stdout.Write(vm.out)
+	}
+}
 
-		panic(NOT_ENOUGH_ARGS_ERROR)
+// popArgs takes count values from the front of the argument stack. ok is false once NOT_ENOUGH_ARGS_ERROR has been thrown.
+// popped shares its array with the argument stack, anything kept past the next ADDARG has to be copied
+func (vm *VM) popArgs(count int, inst *Instruction) (popped []Value, ok bool) {
+	if len(vm.args) < count {
+		vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+		return nil, false
+	}
+	if count == len(vm.args) {
+		// an emptied queue starts again at the front of its array instead of creeping along it, so ADDARG doesn't keep growing it
+		popped, vm.args = vm.args, vm.args[:0]
+		return popped, true
 	}
-	popped := args[:number]
-	remaining := args[number:]
-	return popped, remaining
+	popped, vm.args = vm.args[:count], vm.args[count:]
+	return popped, true
 }
 
-func getNumericArgs(args *[]interface{}, count int) ([]int, error) {
-	poppedArgs, remainingArgs := pop_args_and_return(count, *args)
-	*args = remainingArgs
+// callArgs pops the arguments of a CALL, SPAWN or GEN of fn: as many as the instruction says, fn's own count for %, or none
+func (vm *VM) callArgs(fn function, inst *Instruction) ([]Value, bool) {
+	count := 0
+	if inst.Argument > 0 {
+		count = inst.Argument
+	} else if inst.Args {
+		count = fn.argument_count
+	}
+	return vm.popArgs(count, inst)
+}
 
-	numericArgs := make([]int, count)
-	for i, arg := range poppedArgs {
-		if val, ok := arg.(int); ok {
-			numericArgs[i] = val
-		} else {
-			return nil, fmt.Errorf("%s: %v", BAD_ARGUMENT_ERROR, arg)
+// numericArgs pops count values off the argument stack, which all have to be numbers.
+// ok is false once an error has been thrown
+func (vm *VM) numericArgs(count int, inst *Instruction) ([]Value, bool) {
+	popped, ok := vm.popArgs(count, inst)
+	if !ok {
+		return nil, false
+	}
+	for _, arg := range popped {
+		if !arg.IsNumber() {
+			vm.throwError(fmt.Sprintf("%s: %s: %v", ARITHMETIC_ERROR, BAD_ARGUMENT_ERROR, arg), inst)
+			return nil, false
 		}
 	}
-	return numericArgs, nil
+	return popped, true
 }
@@ -0,0 +1,254 @@
+package twist
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// loadSource builds a VM for source that prints into out
+func loadSource(t *testing.T, source string) (vm *VM, out *bytes.Buffer) {
+	t.Helper()
+	instructions, err := NewLoader().LoadSource("", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = NewVM(instructions)
+	out = new(bytes.Buffer)
+	vm.stdout = out
+	vm.stderr = out
+	return vm, out
+}
+
+// runSource runs source to its end and returns what it printed
+func runSource(t *testing.T, source string) string {
+	t.Helper()
+	vm, out := loadSource(t, source)
+	vm.Run()
+	return out.String()
+}
+
+// runTailCalls runs source for at most steps instructions, with tail calls reusing the frame or with every CALL
+// pushing one, and returns what it printed and how deep the stacks got
+func runTailCalls(t *testing.T, source string, optimise bool, steps int) (out string, maxData, maxCalls int) {
+	t.Helper()
+	vm, buf := loadSource(t, source)
+	if !optimise {
+		for i := range vm.C.code {
+			vm.C.code[i].tail = false
+		}
+	}
+	for i := 0; i < steps && vm.Step(); i++ {
+		maxData = max(maxData, len(vm.dataStack))
+		maxCalls = max(maxCalls, len(vm.callStack))
+	}
+	return buf.String(), maxData, maxCalls
+}
+
+func TestTailCallKeepsStacksFlat(t *testing.T) {
+	// a return lands two past its CALL, so OUT "never" is skipped and the RET after it is where "down" returns to
+	const source = `DEF "down" 1
+CMP 0
+JIZ -5
+ADD -1
+ADDARG
+CALL "down" 1
+OUT "never"
+RET
+NEWV 100000
+ADDARG
+CALL "down" 1
+OUT "skipped"
+OUT "done"
+`
+	out, maxData, maxCalls := runTailCalls(t, source, true, 1_000_000)
+	if maxData > 2 || maxCalls > 1 {
+		t.Errorf("100000 tail calls grew the stacks to %d VWheels and %d return addresses, want 2 and 1", maxData, maxCalls)
+	}
+	if want, _, _ := runTailCalls(t, source, false, 1_000_000); out != want || want != "done\n" {
+		t.Errorf("output %q with tail calls and %q without, want %q", out, want, "done\n")
+	}
+}
+
+func TestCallBeforeRetIsNotATailCall(t *testing.T) {
+	// g's RET is right after the CALL, so it is skipped when f returns and g runs on into itself
+	const source = `DEF "f" 0
+OUT "in f"
+RET
+DEF "g" 0
+CALL "f" 0
+RET
+CALL "g" 0
+OUT "skipped"
+OUT "main after g"
+`
+	out, _, _ := runTailCalls(t, source, true, 200)
+	want, _, _ := runTailCalls(t, source, false, 200)
+	if out != want {
+		t.Errorf("output %q with tail calls, want %q as without", out, want)
+	}
+}
+
+func TestArgumentStackIsFirstInFirstOut(t *testing.T) {
+	const source = `NEWV 1
+ADDARG
+NEWV 2
+MOVVW 1
+ADDARG
+DUPARG
+ARGC
+POPARG
+CMP %
+PEEKARG
+`
+	vm, _ := loadSource(t, source)
+	for vm.Step() {
+	}
+	want := []Value{IntValue(1), IntValue(2), IntValue(3), IntValue(1), IntValue(1)}
+	if got := vm.dataStack[0].data; !reflect.DeepEqual(got, want) {
+		t.Errorf("VWheel %v, want %v", got, want)
+	}
+	if want := []Value{IntValue(1), IntValue(2)}; !reflect.DeepEqual(vm.args, want) {
+		t.Errorf("argument stack %v, want %v", vm.args, want)
+	}
+	if !vm.dataStack[0].CMPFLAG {
+		t.Error("CMP % compared 2 with 1 and left CMPFLAG false")
+	}
+}
+
+func TestNestedWheelsSurviveSnapshot(t *testing.T) {
+	const source = `NEWV 0
+NEST
+ADDARG
+ENTER
+NEWV 1
+NEWV 2
+POPARG
+EXIT
+`
+	vm, _ := loadSource(t, source)
+	// stop inside the nested wheel, before EXIT
+	for vm.C.cursor < 7 && vm.Step() {
+	}
+	if got, want := vm.dataStack[0].data[0].String(), "{1 2 {...}}"; got != want {
+		t.Errorf("nested wheel %s, want %s", got, want)
+	}
+
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewVM(nil)
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	inner := restored.wheel()
+	if len(inner.data) != 3 || &inner.data[2].p.wheel != inner {
+		t.Errorf("restored wheel %v doesn't hold itself", inner.data)
+	}
+	restored.Run()
+	if got, want := restored.wheel().data[0].String(), "{1 2 {...}}"; got != want {
+		t.Errorf("after EXIT the global VWheel holds %s, want %s", got, want)
+	}
+}
+
+func TestMapInstructions(t *testing.T) {
+	const source = `NEWM
+NEWV "b"
+NEWV 2
+MPUT
+MOVVW 1
+CAT "x"
+ADDARG
+MOVVW 1
+ADDARG
+MOVVW 1
+MPUT %
+MDEL
+MGET
+`
+	vm, _ := loadSource(t, source)
+	for vm.Step() {
+	}
+	wheel := &vm.dataStack[0]
+	if got, want := wheel.data[0].String(), "(b:2)"; got != want {
+		t.Errorf("map %s, want %s", got, want)
+	}
+	if wheel.CMPFLAG || len(wheel.data) != 3 {
+		t.Errorf("MGET of a deleted key left CMPFLAG %v and pushed onto %v", wheel.CMPFLAG, wheel.data)
+	}
+
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewVM(nil)
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	entries, ok := restored.dataStack[0].data[0].Entries()
+	if want := map[Value]Value{StringValue("b"): IntValue(2)}; !ok || !reflect.DeepEqual(entries, want) {
+		t.Errorf("restored map %v, want %v", entries, want)
+	}
+}
+
+func TestShortArgumentStackIsHandled(t *testing.T) {
+	const source = `DEF "f" 2
+OUT "in f"
+RET
+NEWV "x"
+ADDARG
+DEL %
+ERRH "ARITHMETIC_ERROR" -2
+OUT "slept"
+OUT "del handled"
+DIV 1 %
+ERRH "NOT_ENOUGH_ARGS_ERROR" -2
+OUT "divided"
+OUT "div handled"
+ADDARG
+CALL "f" 2
+ERRH "NOT_ENOUGH_ARGS_ERROR" -2
+OUT "called"
+OUT "call handled"
+`
+	if got, want := runSource(t, source), "del handled\ndiv handled\ncall handled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestStringInstructionsOnEmptyWheel(t *testing.T) {
+	const source = `CAT "x"
+ERRH "EMPTY_VWHEEL_ERROR" -2
+OUT "concatenated"
+OUT "cat handled"
+LEN
+ERRH "EMPTY_VWHEEL_ERROR" -2
+OUT "measured"
+OUT "len handled"
+`
+	if got, want := runSource(t, source), "cat handled\nlen handled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestOperandsOutsideTheShapesStillRun(t *testing.T) {
+	// the string in a JIZ is a label nothing reads, the jump wraps around to the last line
+	if got, want := runSource(t, "NEWV 1\nJIZ \"NEVER\" 2\nOUT \"a\"\nOUT \"b\"\n"), "b\n"; got != want {
+		t.Errorf("JIZ with a label printed %q, want %q", got, want)
+	}
+
+	// OUT prints the cursor whatever int it is given, and the checker warns that the int is ignored
+	const source = "NEWV 1\nOUT 5\n"
+	if got, want := runSource(t, source), "1 \n"; got != want {
+		t.Errorf("OUT 5 printed %q, want %q", got, want)
+	}
+	instructions, err := NewLoader().LoadSource("", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := checkProgram(instructions)
+	if len(diags) != 1 || diags[0].Severity != SeverityWarning {
+		t.Errorf("checking OUT 5 reported %v, want one warning", diags)
+	}
+}
@@ -0,0 +1,511 @@
+package twist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A small Language Server Protocol server over stdio (`twist lsp`).
+// Documents are synced in full on every change and re-parsed on each request, .whl files are tiny
+
+type lspRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspInternalError  = -32603
+)
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+// lspNull is the result of a request that succeeded with nothing to return, a response without a result is an error
+var lspNull = json.RawMessage("null")
+
+// decodeParams decodes the params of a request, a client sending the wrong shape gets an invalid params error back
+func decodeParams(req lspRequest, v interface{}) error {
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		return &lspError{Code: lspInvalidParams, Message: fmt.Sprintf("%s: %v", req.Method, err)}
+	}
+	return nil
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]string
+}
+
+// ServeLSP answers Language Server Protocol requests from in on out until in ends or the client exits
+func ServeLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{
+		in:        bufio.NewReader(in),
+		out:       out,
+		documents: make(map[string]string),
+	}
+	for {
+		body, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req lspRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			// the id can't be read either, so the error goes back with a null one
+			if err := s.write(lspResponse{JSONRPC: "2.0", Error: &lspError{Code: lspParseError, Message: err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req)
+		if req.ID == nil {
+			// notifications never get a response
+			continue
+		}
+		resp := lspResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+		if err != nil {
+			resp.Result = nil
+			resp.Error, _ = err.(*lspError)
+			if resp.Error == nil {
+				resp.Error = &lspError{Code: lspInternalError, Message: err.Error()}
+			}
+		} else if result == nil {
+			resp.Result = lspNull
+		}
+		if err := s.write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) read() ([]byte, error) {
+	headers, err := textproto.NewReader(s.in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(headers.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %v", err)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *lspServer) write(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *lspServer) handle(req lspRequest) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1,
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"referencesProvider": true,
+				"inlayHintProvider":  true,
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"\""},
+				},
+			},
+			"serverInfo": map[string]string{"name": "twist"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		s.documents[params.TextDocument.URI] = params.TextDocument.Text
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) > 0 {
+			s.documents[params.TextDocument.URI] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		}
+		return nil, s.publishDiagnostics(params.TextDocument.URI)
+	case "textDocument/didClose":
+		var params lspTextDocumentPosition
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.write(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+			"uri":         params.TextDocument.URI,
+			"diagnostics": []interface{}{},
+		}})
+	case "textDocument/hover":
+		return s.withPosition(req, s.hover)
+	case "textDocument/definition":
+		return s.withPosition(req, s.definition)
+	case "textDocument/references":
+		return s.withPosition(req, s.references)
+	case "textDocument/completion":
+		return s.withPosition(req, s.completion)
+	case "textDocument/inlayHint":
+		var params struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Range lspRange `json:"range"`
+		}
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return s.inlayHints(params.TextDocument.URI, params.Range), nil
+	}
+	if req.ID == nil {
+		return nil, nil
+	}
+	return nil, &lspError{Code: lspMethodNotFound, Message: fmt.Sprintf("method not found: %s", req.Method)}
+}
+
+func (s *lspServer) withPosition(req lspRequest, handler func(uri string, pos lspPosition) interface{}) (interface{}, error) {
+	var params lspTextDocumentPosition
+	if err := decodeParams(req, &params); err != nil {
+		return nil, err
+	}
+	return handler(params.TextDocument.URI, params.Position), nil
+}
+
+// document returns the source lines and instructions of an open document, linked with its imports.
+// Imported instructions come after the document's own and have File set.
+// instructions is nil when the document doesn't parse
+func (s *lspServer) document(uri string) ([]string, []Instruction) {
+	text := s.documents[uri]
+	instructions, err := NewLoader().LoadSource(uriPath(uri), text)
+	if err != nil {
+		// a broken import shouldn't take hover and completion down with it
+		instructions, _ = parseProgram(text)
+	}
+	return strings.Split(text, "\n"), instructions
+}
+
+func uriPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return uri
+}
+
+// locate finds where the name in a DEF or CALL is written, in the document or the module it was imported from.
+// Inside a module the name is written without the aliases it was namespaced with.
+// The standard library has no file an editor could open, so it has no location
+func locate(uri string, lines []string, inst Instruction) (lspLocation, bool) {
+	if inst.File == "" {
+		r, _ := quotedRange(lines, inst.Line, inst.ArgumentStr)
+		return lspLocation{URI: uri, Range: r}, true
+	}
+	if _, _, ok := stdModule(inst.File); ok {
+		return lspLocation{}, false
+	}
+	path, _ := filepath.Abs(inst.File)
+	source, _ := ReadSource(inst.File)
+	lines = strings.Split(source, "\n")
+	name := inst.ArgumentStr
+	for {
+		r, ok := quotedRange(lines, inst.Line, name)
+		if ok || !strings.Contains(name, ".") {
+			return lspLocation{URI: (&url.URL{Scheme: "file", Path: path}).String(), Range: r}, true
+		}
+		name = name[strings.Index(name, ".")+1:]
+	}
+}
+
+func (s *lspServer) publishDiagnostics(uri string) error {
+	text := s.documents[uri]
+	lines := strings.Split(text, "\n")
+
+	var diags []Diagnostic
+	instructions, err := NewLoader().LoadSource(uriPath(uri), text)
+	if perr, ok := err.(*ParseError); ok {
+		diags = append(diags, Diagnostic{Line: perr.Line, Severity: SeverityError, Message: perr.Message})
+	} else if err != nil {
+		diags = append(diags, Diagnostic{Severity: SeverityError, Message: err.Error()})
+	} else {
+		diags = checkProgram(instructions)
+	}
+
+	out := []interface{}{}
+	for _, d := range diags {
+		if d.File != "" {
+			continue
+		}
+		out = append(out, map[string]interface{}{
+			"range":    lineRange(lines, d.Line),
+			"severity": d.Severity,
+			"source":   "twist",
+			"message":  d.Message,
+		})
+	}
+	return s.write(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": out,
+	}})
+}
+
+func (s *lspServer) hover(uri string, pos lspPosition) interface{} {
+	lines, instructions := s.document(uri)
+	inst, found := instructionOnLine(instructions, pos.Line)
+	if !found {
+		return nil
+	}
+
+	var contents string
+	if nameRange, ok := quotedRange(lines, inst.Line, inst.ArgumentStr); ok && inRange(pos, nameRange) {
+		switch {
+		case namesFunction(inst.Mnemonic):
+			if fn, ok := collectFunctions(instructions)[inst.ArgumentStr]; ok {
+				contents = fmt.Sprintf("```\nDEF \"%s\" %d\n```\nDefined on line %s", inst.ArgumentStr, fn.argument_count, instructions[fn.line-1].Location())
+			}
+		case inst.Mnemonic == "ERRH":
+			if message, ok := errorNames[inst.ArgumentStr]; ok {
+				contents = fmt.Sprintf("Handles `%s`", message)
+			}
+		}
+	}
+	if contents == "" {
+		doc, ok := lookupMnemonic(inst.Mnemonic)
+		if !ok {
+			return nil
+		}
+		contents = fmt.Sprintf("```\n%s\n```\n%s", doc.Signature, doc.Doc)
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": contents},
+	}
+}
+
+func (s *lspServer) definition(uri string, pos lspPosition) interface{} {
+	lines, instructions := s.document(uri)
+	inst, found := instructionOnLine(instructions, pos.Line)
+	if !found || !namesFunction(inst.Mnemonic) {
+		return nil
+	}
+	fn, ok := collectFunctions(instructions)[inst.ArgumentStr]
+	if !ok {
+		return nil
+	}
+	if location, ok := locate(uri, lines, instructions[fn.line-1]); ok {
+		return location
+	}
+	return nil
+}
+
+func (s *lspServer) references(uri string, pos lspPosition) interface{} {
+	lines, instructions := s.document(uri)
+	inst, found := instructionOnLine(instructions, pos.Line)
+	if !found || !namesFunction(inst.Mnemonic) {
+		return nil
+	}
+	locations := []lspLocation{}
+	for _, other := range instructions {
+		if namesFunction(other.Mnemonic) && other.ArgumentStr == inst.ArgumentStr {
+			if location, ok := locate(uri, lines, other); ok {
+				locations = append(locations, location)
+			}
+		}
+	}
+	return locations
+}
+
+func (s *lspServer) completion(uri string, pos lspPosition) interface{} {
+	lines, instructions := s.document(uri)
+	if pos.Line >= len(lines) {
+		return nil
+	}
+	line := lines[pos.Line]
+	if pos.Character < len(line) {
+		line = line[:pos.Character]
+	}
+	prefix := strings.TrimLeft(line, " \t")
+	quoted := strings.Count(prefix, "\"")%2 == 1
+
+	items := []interface{}{}
+	quote := func(name string) string {
+		if quoted {
+			return name
+		}
+		return "\"" + name + "\""
+	}
+
+	switch {
+	case !strings.ContainsAny(prefix, " \t"):
+		for _, m := range instructionSet {
+			items = append(items, map[string]interface{}{
+				"label":         m.Name,
+				"kind":          14,
+				"detail":        m.Signature,
+				"documentation": m.Doc,
+			})
+		}
+	case strings.HasPrefix(prefix, "ERRH"):
+		for name, message := range errorNames {
+			items = append(items, map[string]interface{}{
+				"label":      name,
+				"kind":       21,
+				"detail":     message,
+				"insertText": quote(name),
+			})
+		}
+	case namesFunction(strings.Fields(prefix)[0]) && !strings.HasPrefix(prefix, "DEF"):
+		// every instruction naming a function but DEF, which names a new one
+		for name, fn := range collectFunctions(instructions) {
+			items = append(items, map[string]interface{}{
+				"label":      name,
+				"kind":       3,
+				"detail":     fmt.Sprintf("DEF \"%s\" %d", name, fn.argument_count),
+				"insertText": quote(name),
+			})
+		}
+	}
+	return items
+}
+
+func (s *lspServer) inlayHints(uri string, r lspRange) interface{} {
+	lines, instructions := s.document(uri)
+	hints := []interface{}{}
+	for i, inst := range instructions {
+		if inst.File != "" || inst.Line < r.Start.Line || inst.Line > r.End.Line {
+			continue
+		}
+		target, ok := branchTarget(instructions, i)
+		if !ok {
+			continue
+		}
+		label := "→ end"
+		if target < len(instructions) {
+			label = fmt.Sprintf("→ line %s", instructions[target].Location())
+		}
+		hints = append(hints, map[string]interface{}{
+			"position":    lineRange(lines, inst.Line).End,
+			"label":       label,
+			"paddingLeft": true,
+		})
+	}
+	return hints
+}
+
+func instructionOnLine(instructions []Instruction, line int) (Instruction, bool) {
+	for _, inst := range instructions {
+		if inst.File == "" && inst.Line == line {
+			return inst, true
+		}
+	}
+	return Instruction{}, false
+}
+
+// lineRange covers a whole line, without any trailing comment
+func lineRange(lines []string, line int) lspRange {
+	end := 0
+	if line < len(lines) {
+		text := lines[line]
+		if i := strings.Index(text, ";"); i >= 0 {
+			text = text[:i]
+		}
+		end = len(strings.TrimRight(text, " \t"))
+	}
+	return lspRange{Start: lspPosition{Line: line}, End: lspPosition{Line: line, Character: end}}
+}
+
+// quotedRange finds the range of a string argument (without its quotes) on a line,
+// falling back to the whole line when it isn't there
+func quotedRange(lines []string, line int, value string) (lspRange, bool) {
+	if line < len(lines) && value != "" {
+		if i := strings.Index(lines[line], "\""+value+"\""); i >= 0 {
+			return lspRange{
+				Start: lspPosition{Line: line, Character: i + 1},
+				End:   lspPosition{Line: line, Character: i + 1 + len(value)},
+			}, true
+		}
+	}
+	return lineRange(lines, line), false
+}
+
+func inRange(pos lspPosition, r lspRange) bool {
+	return pos.Line == r.Start.Line && pos.Character >= r.Start.Character && pos.Character <= r.End.Character
+}
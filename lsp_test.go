@@ -0,0 +1,184 @@
+package twist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lspExchange sends messages to the server, which are either JSON or raw bodies as strings,
+// and returns everything it wrote back decoded
+func lspExchange(t *testing.T, messages ...interface{}) []map[string]interface{} {
+	t.Helper()
+	var in bytes.Buffer
+	for _, m := range messages {
+		body, ok := m.(string)
+		if !ok {
+			data, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = string(data)
+		}
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	var out bytes.Buffer
+	if err := ServeLSP(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var replies []map[string]interface{}
+	s := &lspServer{in: bufio.NewReader(&out)}
+	for out.Len() > 0 || s.in.Buffered() > 0 {
+		body, err := s.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply map[string]interface{}
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func lspMessage(id int, method string, params interface{}) map[string]interface{} {
+	m := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if id != 0 {
+		m["id"] = id
+	}
+	return m
+}
+
+const lspURI = "file:///test.whl"
+
+const lspSource = `DEF "f" 0
+RET
+CALL "f"
+CALL "missing"
+JMP -1
+OUT
+`
+
+func openDocument(text string) map[string]interface{} {
+	return lspMessage(0, "textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]string{"uri": lspURI, "text": text},
+	})
+}
+
+// lspJSON turns v into the form a reply decodes into, to compare them
+func lspJSON(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	replies := lspExchange(t, openDocument(lspSource))
+	if len(replies) != 1 || replies[0]["method"] != "textDocument/publishDiagnostics" {
+		t.Fatalf("opening a document got %v, want its diagnostics", replies)
+	}
+	diags := replies[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 {
+		t.Fatalf("diagnostics %v, want one for the missing function", diags)
+	}
+	want := lspJSON(t, map[string]interface{}{
+		"range":    lspRange{Start: lspPosition{Line: 3}, End: lspPosition{Line: 3, Character: 14}},
+		"severity": SeverityError,
+		"source":   "twist",
+		"message":  UNDEFINED_FUNCTION_ERROR + " 'missing'",
+	})
+	if !reflect.DeepEqual(diags[0], want) {
+		t.Errorf("diagnostic %v, want %v", diags[0], want)
+	}
+
+	// a document that doesn't parse reports the line it stopped on
+	replies = lspExchange(t, openDocument("OUT\nJMP\nOUT\n"))
+	diags = replies[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	if len(diags) != 1 || diags[0].(map[string]interface{})["range"].(map[string]interface{})["start"].(map[string]interface{})["line"] != 1.0 {
+		t.Errorf("a parse error reported %v, want it on line 1", diags)
+	}
+}
+
+func TestLSPDefinitionAndInlayHints(t *testing.T) {
+	position := func(line, character int) map[string]interface{} {
+		return map[string]interface{}{
+			"textDocument": map[string]string{"uri": lspURI},
+			"position":     lspPosition{Line: line, Character: character},
+		}
+	}
+	replies := lspExchange(t,
+		openDocument(lspSource),
+		lspMessage(1, "textDocument/definition", position(2, 7)),
+		lspMessage(2, "textDocument/definition", position(3, 7)),
+		lspMessage(3, "textDocument/inlayHint", map[string]interface{}{
+			"textDocument": map[string]string{"uri": lspURI},
+			"range":        lspRange{End: lspPosition{Line: 6}},
+		}),
+	)
+	if len(replies) != 4 {
+		t.Fatalf("got %d messages, want the diagnostics and three responses: %v", len(replies), replies)
+	}
+
+	want := lspJSON(t, lspLocation{URI: lspURI, Range: lspRange{Start: lspPosition{Character: 5}, End: lspPosition{Character: 6}}})
+	if got := replies[1]["result"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("definition of f is %v, want %v", got, want)
+	}
+	if result, ok := replies[2]["result"]; !ok || result != nil {
+		t.Errorf("definition of an undefined function is %v, want a null result", replies[2])
+	}
+
+	hints := lspJSON(t, []interface{}{map[string]interface{}{
+		"position":    lspPosition{Line: 4, Character: 6},
+		"label":       "→ line 6",
+		"paddingLeft": true,
+	}})
+	if got := replies[3]["result"]; !reflect.DeepEqual(got, hints) {
+		t.Errorf("inlay hints %v, want %v", got, hints)
+	}
+}
+
+func TestLSPErrors(t *testing.T) {
+	replies := lspExchange(t,
+		lspMessage(1, "textDocument/unknown", nil),
+		lspMessage(2, "textDocument/hover", []int{1, 2}),
+		"{not json",
+		lspMessage(3, "shutdown", nil),
+	)
+	codes := []float64{lspMethodNotFound, lspInvalidParams, lspParseError}
+	if len(replies) != 4 {
+		t.Fatalf("got %d responses, want 4: %v", len(replies), replies)
+	}
+	for i, code := range codes {
+		e, _ := replies[i]["error"].(map[string]interface{})
+		if e == nil || e["code"] != code {
+			t.Errorf("response %d is %v, want error code %v", i, replies[i], code)
+		}
+		if _, ok := replies[i]["result"]; ok {
+			t.Errorf("error response %d has a result: %v", i, replies[i])
+		}
+	}
+	if id, ok := replies[2]["id"]; !ok || id != nil {
+		t.Errorf("the parse error went back with id %v, want null", id)
+	}
+
+	// the server kept going after the malformed message, and a success always has a result
+	if result, ok := replies[3]["result"]; replies[3]["id"] != 3.0 || !ok || result != nil || replies[3]["error"] != nil {
+		t.Errorf("shutdown got %v, want a null result", replies[3])
+	}
+	if !strings.Contains(replies[1]["error"].(map[string]interface{})["message"].(string), "textDocument/hover") {
+		t.Errorf("invalid params error %v doesn't name the method", replies[1]["error"])
+	}
+}
@@ -0,0 +1,114 @@
+package twist
+
+import "fmt"
+
+// A map cell looks values up by key instead of scanning the wheel with CMP and JIZ.
+// NEWM puts a new empty map in the cell under the cursor, and the other instructions work on the map at the cursor:
+// MPUT stores a value under a key, MGET pushes the value stored under a key, MDEL removes one and MKEYS pushes every key.
+// The key, and the value for MPUT, come from the cells after the cursor, moving in the wheel's direction like MOVVW,
+// or with % from the front of the argument stack, key first.
+// Like a nested wheel, a map is shared by every cell it is copied to
+
+// cursorMap is the map in the cell at the cursor, nil once an error has been thrown
+func (vm *VM) cursorMap(currentVWheel *VWheel, inst *Instruction) valueMap {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return nil
+	}
+	cell := currentVWheel.data[currentVWheel.cursor]
+	if cell.Kind() != KindMap {
+		vm.throwError(fmt.Sprintf("%s: %v is not a map", BAD_ARGUMENT_ERROR, cell), inst)
+		return nil
+	}
+	return cell.p.entries
+}
+
+// mapOperands takes the key, and the value after it if count is 2, from the cells after the cursor or the argument stack.
+// ok is false once an error has been thrown
+func (vm *VM) mapOperands(currentVWheel *VWheel, count int, inst *Instruction) (operands []Value, ok bool) {
+	if inst.Args {
+		if operands, ok = vm.popArgs(count, inst); !ok {
+			return nil, false
+		}
+	} else {
+		n := len(currentVWheel.data)
+		// the map's own cell doesn't count
+		if n <= count {
+			vm.throwError(NOT_ENOUGH_ARGS_ERROR, inst)
+			return nil, false
+		}
+		for steps := 1; steps <= count; steps++ {
+			if currentVWheel.dir == 1 {
+				operands = append(operands, currentVWheel.data[mod(currentVWheel.cursor+steps, n)])
+			} else {
+				operands = append(operands, currentVWheel.data[mod(currentVWheel.cursor-steps, n)])
+			}
+		}
+	}
+	if !operands[0].IsKey() {
+		vm.throwError(fmt.Sprintf("%s: %v can't be a map key", BAD_ARGUMENT_ERROR, operands[0]), inst)
+		return nil, false
+	}
+	return operands, true
+}
+
+func (vm *VM) opNEWM(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		currentVWheel.data = append(currentVWheel.data, MapValue(nil))
+	} else {
+		currentVWheel.data[currentVWheel.cursor] = MapValue(nil)
+	}
+	return Next
+}
+
+func (vm *VM) opMPUT(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	m := vm.cursorMap(currentVWheel, inst)
+	if m == nil {
+		return Next
+	}
+	if operands, ok := vm.mapOperands(currentVWheel, 2, inst); ok {
+		m[operands[0]] = operands[1]
+	}
+	return Next
+}
+
+func (vm *VM) opMGET(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	m := vm.cursorMap(currentVWheel, inst)
+	if m == nil {
+		return Next
+	}
+	operands, ok := vm.mapOperands(currentVWheel, 1, inst)
+	if !ok {
+		return Next
+	}
+	value, found := m[operands[0]]
+	if found {
+		currentVWheel.data = append(currentVWheel.data, value)
+	}
+	currentVWheel.CMPFLAG = found
+	return Next
+}
+
+func (vm *VM) opMDEL(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	m := vm.cursorMap(currentVWheel, inst)
+	if m == nil {
+		return Next
+	}
+	operands, ok := vm.mapOperands(currentVWheel, 1, inst)
+	if !ok {
+		return Next
+	}
+	_, found := m[operands[0]]
+	delete(m, operands[0])
+	currentVWheel.CMPFLAG = found
+	return Next
+}
+
+func (vm *VM) opMKEYS(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	m := vm.cursorMap(currentVWheel, inst)
+	if m == nil {
+		return Next
+	}
+	currentVWheel.data = append(currentVWheel.data, sortedKeys(m)...)
+	return Next
+}
@@ -0,0 +1,253 @@
+package twist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Loader links a program with the modules it IMPORTs into a single CWheel.
+//
+// The program keeps its place at the start of the wheel and every module is appended after it,
+// running off the end of the program still ends it rather than carrying on into a module.
+// A module may only contain DEF blocks and IMPORTs, its functions are renamed to "alias.name"
+// (and "alias.inner.name" for what it imports itself) and CALLs inside it are renamed to match.
+// Relative jumps need no fixing, except for the ones that only reach their target by wrapping
+// around the end of their own file, which are rewritten to land on the same instruction in the bigger wheel
+type Loader struct {
+	// SearchPath is where imports that aren't relative to the importing file are looked for
+	SearchPath []string
+	// ReadFile reads a module, ReadSource by default
+	ReadFile func(path string) (string, error)
+
+	// loading is the chain of files being imported, to catch cycles
+	loading []string
+}
+
+// NewLoader makes a loader searching the directories in TWIST_PATH (separated like PATH)
+func NewLoader() *Loader {
+	l := &Loader{ReadFile: ReadSource}
+	if env := os.Getenv("TWIST_PATH"); env != "" {
+		l.SearchPath = filepath.SplitList(env)
+	}
+	return l
+}
+
+// Load reads a program from a file and links its imports
+func (l *Loader) Load(path string) ([]Instruction, error) {
+	source, err := l.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file: %v", err)
+	}
+	return l.LoadSource(path, source)
+}
+
+// LoadSource links a program whose source is already in memory, path is only used to resolve imports
+func (l *Loader) LoadSource(path, source string) ([]Instruction, error) {
+	units, err := l.link(path, source, "")
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, unit := range units {
+		total += len(unit)
+	}
+	var instructions []Instruction
+	for _, unit := range units {
+		relocate(unit, total)
+		instructions = append(instructions, unit...)
+	}
+	return instructions, nil
+}
+
+// link parses a file and everything it imports. The first unit is the file itself, followed by
+// the units of its imports, with every function name inside them already namespaced
+func (l *Loader) link(path, source, file string) ([][]Instruction, error) {
+	instructions, err := parseProgram(source)
+	if err != nil {
+		if perr, ok := err.(*ParseError); ok && file != "" {
+			return nil, fmt.Errorf("%s: %v", file, perr)
+		}
+		return nil, err
+	}
+	for i := range instructions {
+		instructions[i].File = file
+	}
+	if file != "" {
+		if err := checkModule(file, instructions); err != nil {
+			return nil, err
+		}
+	}
+
+	units := [][]Instruction{instructions}
+	aliases := make(map[string]bool)
+	for _, inst := range instructions {
+		if inst.Mnemonic != "IMPORT" {
+			continue
+		}
+		moduleUnits, err := l.importModule(path, inst, aliases)
+		if err != nil {
+			// errors in the program itself point at the IMPORT, so the LSP can show them on that line
+			if file == "" {
+				if _, ok := err.(*ParseError); !ok {
+					err = &ParseError{Line: inst.Line, Message: err.Error()}
+				}
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s line %d: %v", path, inst.Line+1, err)
+		}
+		units = append(units, moduleUnits...)
+	}
+	return units, nil
+}
+
+func (l *Loader) importModule(path string, inst Instruction, aliases map[string]bool) ([][]Instruction, error) {
+	alias := inst.Alias
+	if alias == "" {
+		alias = strings.TrimSuffix(filepath.Base(inst.ArgumentStr), ".whl")
+	}
+	if aliases[alias] {
+		return nil, fmt.Errorf("a module is already imported as %s", alias)
+	}
+	aliases[alias] = true
+
+	resolved, err := l.resolve(path, inst.ArgumentStr)
+	if err != nil {
+		return nil, err
+	}
+	for i, loading := range l.loading {
+		if loading == resolved {
+			chain := append(append([]string{}, l.loading[i:]...), resolved)
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(chain, " -> "))
+		}
+	}
+	source, err := l.read(resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	l.loading = append(l.loading, resolved)
+	units, err := l.link(resolved, source, resolved)
+	l.loading = l.loading[:len(l.loading)-1]
+	if err != nil {
+		return nil, err
+	}
+	namespace(units, alias)
+	return units, nil
+}
+
+func (l *Loader) read(path string) (string, error) {
+	if _, source, ok := stdModule(path); ok {
+		return source, nil
+	}
+	return l.ReadFile(path)
+}
+
+// resolve finds an imported file next to the file importing it, then on the search path.
+// Anything under std/ is the bundled standard library. The .whl extension can be left off
+func (l *Loader) resolve(from, name string) (string, error) {
+	if strings.HasPrefix(name, "std/") {
+		if path, _, ok := stdModule(name); ok {
+			return path, nil
+		}
+		return "", fmt.Errorf("no module %q in the standard library", name)
+	}
+	candidates := []string{name}
+	if !strings.HasSuffix(name, ".whl") {
+		candidates = append(candidates, name+".whl")
+	}
+	var dirs []string
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	} else {
+		dirs = append([]string{filepath.Dir(from)}, l.SearchPath...)
+	}
+	for _, dir := range dirs {
+		for _, candidate := range candidates {
+			path := filepath.Join(dir, candidate)
+			if _, err := os.Stat(path); err == nil {
+				return filepath.Clean(path), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("can't find module %q", name)
+}
+
+// checkModule makes sure a module has nothing that would run on its own: before its first DEF there
+// can only be IMPORTs, everything after belongs to a function (code after an early RET included)
+func checkModule(file string, instructions []Instruction) error {
+	inFunction := false
+	for i, inst := range instructions {
+		switch inst.Mnemonic {
+		case "DEF":
+			inFunction = true
+			terminated := false
+			for j := i + 1; j < len(instructions) && !terminated; j++ {
+				terminated = instructions[j].Mnemonic == "RET"
+			}
+			if !terminated {
+				return fmt.Errorf("%s line %d: %s: function '%s' has no RET", file, inst.Line+1, INCORRECT_TERMINATION_ERROR, inst.ArgumentStr)
+			}
+		case "IMPORT":
+		default:
+			if !inFunction {
+				return fmt.Errorf("%s line %d: modules can only contain DEF blocks and IMPORTs, found %s", file, inst.Line+1, inst.Mnemonic)
+			}
+		}
+	}
+	return nil
+}
+
+// namespace prefixes every function defined in a module (and its own imports) with alias,
+// along with every CALL, SPAWN, GEN and FUNC naming one of them
+func namespace(units [][]Instruction, alias string) {
+	defined := make(map[string]bool)
+	for _, unit := range units {
+		for _, inst := range unit {
+			if inst.Mnemonic == "DEF" {
+				defined[inst.ArgumentStr] = true
+			}
+		}
+	}
+	for _, unit := range units {
+		for i := range unit {
+			if namesFunction(unit[i].Mnemonic) && defined[unit[i].ArgumentStr] {
+				unit[i].ArgumentStr = alias + "." + unit[i].ArgumentStr
+			}
+		}
+	}
+}
+
+// relocate rewrites the jumps of a unit placed in a wheel of total instructions that relied on
+// wrapping around the unit's own length, so they keep landing on the same instruction.
+// Like the disassembler it assumes the CWheel direction from the closest WHLDIRC above the jump
+func relocate(unit []Instruction, total int) {
+	n := len(unit)
+	if n == total {
+		return
+	}
+	for i, inst := range unit {
+		from := i
+		switch inst.Mnemonic {
+		case "JMP", "JIZ":
+		case "ERRH":
+			if i == 0 {
+				continue
+			}
+			from = i - 1
+		default:
+			continue
+		}
+		if !wrapsAround(unit, i) {
+			continue
+		}
+		dir := staticDirection(unit, i)
+		target := jumpTarget(from, inst.Argument, dir, n)
+		if dir == 1 {
+			unit[i].Argument = target - from
+		} else {
+			unit[i].Argument = from - target
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package twist
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeModules writes each source into dir under its name and returns the path of main.whl
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "main.whl")
+}
+
+func runModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+	instructions, err := NewLoader().Load(writeModules(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(instructions)
+	out := new(bytes.Buffer)
+	vm.stdout = out
+	vm.stderr = out
+	vm.Run()
+	return out.String()
+}
+
+func TestImportNamespaces(t *testing.T) {
+	// both modules define "name", each CALL inside a module reaches its own
+	out := runModules(t, map[string]string{
+		"main.whl": `IMPORT "lib/greet" as g
+IMPORT "shout"
+CALL "g.hello"
+OUT "skipped"
+CALL "shout.name"
+OUT "skipped"
+CALL "g.p.name"
+OUT "skipped"
+`,
+		"lib/greet.whl": `IMPORT "plain" as p
+DEF "hello" 0
+CALL "name"
+OUT "skipped"
+CALL "p.name"
+OUT "skipped"
+RET
+DEF "name" 0
+OUT "greet"
+RET
+`,
+		"lib/plain.whl": `DEF "name" 0
+OUT "plain"
+RET
+`,
+		"shout.whl": `DEF "name" 0
+OUT "SHOUT"
+RET
+`,
+	})
+	if want := "greet\nplain\nSHOUT\nplain\n"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files map[string]string
+		error string
+	}{
+		{"a cycle", map[string]string{
+			"main.whl": "IMPORT \"a\"\n",
+			"a.whl":    "IMPORT \"b\"\nDEF \"f\" 0\nRET\n",
+			"b.whl":    "IMPORT \"a\"\nDEF \"g\" 0\nRET\n",
+		}, "import cycle: "},
+		{"two modules under one name", map[string]string{
+			"main.whl": "IMPORT \"a\"\nIMPORT \"b\" as a\n",
+			"a.whl":    "DEF \"f\" 0\nRET\n",
+			"b.whl":    "DEF \"g\" 0\nRET\n",
+		}, "already imported as a"},
+		{"code outside a DEF", map[string]string{
+			"main.whl": "IMPORT \"a\"\n",
+			"a.whl":    "OUT \"loose\"\n",
+		}, "modules can only contain DEF blocks and IMPORTs"},
+		{"a missing module", map[string]string{
+			"main.whl": "IMPORT \"nowhere\"\n",
+		}, "can't find module"},
+	} {
+		_, err := NewLoader().Load(writeModules(t, tc.files))
+		if err == nil || !strings.Contains(err.Error(), tc.error) {
+			t.Errorf("%s: loading returned %v, want an error containing %q", tc.name, err, tc.error)
+		}
+	}
+
+	// the cycle names every file on it, a.whl both where it starts and where it closes
+	main := writeModules(t, map[string]string{
+		"main.whl": "IMPORT \"a\"\n",
+		"a.whl":    "IMPORT \"b\"\nDEF \"f\" 0\nRET\n",
+		"b.whl":    "IMPORT \"a\"\nDEF \"g\" 0\nRET\n",
+	})
+	a, b := filepath.Join(filepath.Dir(main), "a.whl"), filepath.Join(filepath.Dir(main), "b.whl")
+	_, err := NewLoader().Load(main)
+	if want := "import cycle: " + a + " -> " + b + " -> " + a; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("cycle error %v, want it to contain %q", err, want)
+	}
+}
+
+func TestImportRelocatesWrappingJumps(t *testing.T) {
+	// in its own file JMP 2 wraps from 1 around the start to the RET at 3, skipping the OUT.
+	// Linked after the program the wheel is bigger, so without relocation it would land somewhere else
+	files := map[string]string{
+		"main.whl": `IMPORT "skip"
+CALL "skip.f"
+OUT "skipped"
+OUT "back"
+OUT "end"
+`,
+		"skip.whl": `DEF "f" 0
+JMP 2
+OUT "wrapped wrong"
+RET
+`,
+	}
+	if got, want := runModules(t, files), "back\nend\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+
+	instructions, err := NewLoader().Load(writeModules(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump := 6
+	if instructions[jump].Mnemonic != "JMP" {
+		t.Fatalf("instruction %d is %s, want the module's JMP", jump, instructions[jump])
+	}
+	if target, _ := branchTarget(instructions, jump); target != 8 {
+		t.Errorf("the module's JMP lands on %d, want its RET at 8", target)
+	}
+}
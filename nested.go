@@ -0,0 +1,54 @@
+package twist
+
+import "fmt"
+
+// A cell can hold a whole wheel, which is how a program builds lists and trees out of wheels.
+// NEST puts a new empty wheel in the cell under the cursor, ENTER makes the wheel in that cell the one
+// instructions work on, with its own cursor, direction and CMPFLAG, and EXIT goes back out to the wheel around it.
+// A wheel in a cell is shared rather than copied, so one passed with ADDARG or PUT is the same wheel in both places.
+// The frame remembers the path of cells it ENTERed, from the wheel it is USEing, and a CALL starts outside all of them
+
+// enteredWheel follows a path of cells from wheel. A step that no longer leads to a wheel, because the cell
+// was overwritten from somewhere else, stops the walk there
+func enteredWheel(wheel *VWheel, path []int) *VWheel {
+	for _, i := range path {
+		if i >= len(wheel.data) || wheel.data[i].kind != KindWheel {
+			break
+		}
+		wheel = &wheel.data[i].p.wheel
+	}
+	return wheel
+}
+
+func (vm *VM) opNEST(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		currentVWheel.data = append(currentVWheel.data, WheelValue())
+	} else {
+		currentVWheel.data[currentVWheel.cursor] = WheelValue()
+	}
+	return Next
+}
+
+func (vm *VM) opENTER(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	if cell := currentVWheel.data[currentVWheel.cursor]; cell.Kind() != KindWheel {
+		vm.throwError(fmt.Sprintf("%s: %v is not a wheel", BAD_ARGUMENT_ERROR, cell), inst)
+		return Next
+	}
+	frame := &vm.dataStack[len(vm.dataStack)-1]
+	frame.entered = append(frame.entered, currentVWheel.cursor)
+	return Next
+}
+
+func (vm *VM) opEXIT(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	frame := &vm.dataStack[len(vm.dataStack)-1]
+	if len(frame.entered) == 0 {
+		vm.throwError(fmt.Sprintf("%s: EXIT outside a nested wheel", BAD_ARGUMENT_ERROR), inst)
+		return Next
+	}
+	frame.entered = frame.entered[:len(frame.entered)-1]
+	return Next
+}
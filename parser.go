@@ -0,0 +1,88 @@
+package twist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type ParseError struct {
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s @ Line %d", e.Message, e.Line+1)
+}
+
+// parseProgram lexes the source and builds the instructions that get loaded onto the CWheel.
+// Every instruction remembers the (0 based) source line it came from
+func parseProgram(input string) (instructions []Instruction, err error) {
+	lexer := NewLexer(input)
+	defer func() {
+		// the lexer panics on anything it can't read, turn that into an error with a line
+		if r := recover(); r != nil {
+			instructions = nil
+			err = &ParseError{Line: lexer.line, Message: fmt.Sprintf("illegal character %q", lexer.char)}
+		}
+	}()
+
+	for {
+		tok := lexer.NextToken()
+		if tok.Type == EOF {
+			break
+		}
+		if tok.Type == INST {
+			arg := 0
+			args := false
+			argF := 0.0
+			str_arg := ""
+			alias := ""
+			argTok := lexer.NextToken()
+			for argTok.Type != NEWLINE && argTok.Type != COMMENT && argTok.Type != EOF {
+				if argTok.Type == INTEGER {
+					arg, _ = strconv.Atoi(argTok.Literal.(string))
+				} else if argTok.Type == FLOAT {
+					argF, _ = strconv.ParseFloat(argTok.Literal.(string), 64)
+				} else if argTok.Type == STRING {
+					str_arg = argTok.Literal.(string)
+				} else if argTok.Type == ARGS {
+					args = true
+				} else if argTok.Type == INST && argTok.Literal == "as" {
+					// IMPORT "lib.whl" as name
+					argTok = lexer.NextToken()
+					if argTok.Type != INST {
+						return nil, &ParseError{Line: argTok.Line, Message: "expected a name after as"}
+					}
+					alias = argTok.Literal.(string)
+				}
+				argTok = lexer.NextToken()
+			}
+			instructions = append(instructions, Instruction{Mnemonic: tok.Literal.(string), Argument: arg, ArgumentF: argF, ArgumentStr: str_arg, Args: args, Alias: alias, Line: tok.Line})
+		}
+	}
+	return instructions, nil
+}
+
+// LoadProgram reads and parses a .whl file, along with everything it IMPORTs
+func LoadProgram(path string) ([]Instruction, error) {
+	return NewLoader().Load(path)
+}
+
+// ReadSource reads a .whl file
+func ReadSource(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return strings.Join(lines, "\n"), scanner.Err()
+}
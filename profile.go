@@ -0,0 +1,402 @@
+package twist
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Profiler records how many times each CWheel position runs and how long it takes,
+// along with the call stack it ran under so time can be rolled up per DEF function.
+// Time for an instruction is measured from when it starts until the next one starts, so DEL shows up where it sleeps
+type Profiler struct {
+	program []Instruction
+	path    string
+	owners  []string
+
+	began   time.Time
+	ended   time.Time
+	samples map[string]*profileSample
+	calls   map[string]int
+
+	pending []int
+	started time.Time
+}
+
+// profileSample is every execution of an instruction under the same call stack.
+// stack is leaf first: the instruction that ran, then the CALL for every frame below it
+type profileSample struct {
+	stack []int
+	count int64
+	nanos int64
+}
+
+func NewProfiler(program []Instruction, path string) *Profiler {
+	return &Profiler{
+		program: program,
+		path:    path,
+		owners:  functionMembership(program),
+		samples: make(map[string]*profileSample),
+		calls:   make(map[string]int),
+	}
+}
+
+// step is called by VM.Run before every instruction
+func (p *Profiler) step(vm *VM) {
+	now := time.Now()
+	if p.began.IsZero() {
+		p.began = now
+	}
+	p.flush(now)
+
+	stack := make([]int, 0, len(vm.callStack)+1)
+	stack = append(stack, vm.C.cursor)
+	for i := len(vm.callStack) - 1; i >= 0; i-- {
+		stack = append(stack, vm.callStack[i]-1)
+	}
+	p.pending = stack
+	p.started = now
+
+	if inst := p.program[vm.C.cursor]; inst.Mnemonic == "CALL" {
+		name := inst.ArgumentStr
+		if wheel := vm.wheel(); name == "" && len(wheel.data) > 0 {
+			name, _ = wheel.data[wheel.cursor].Str()
+		}
+		p.calls[name]++
+	}
+}
+
+// stop charges the last instruction, call it once the VM is done
+func (p *Profiler) stop() {
+	p.ended = time.Now()
+	p.flush(p.ended)
+}
+
+func (p *Profiler) flush(now time.Time) {
+	if p.pending == nil {
+		return
+	}
+	key := profileKey(p.pending)
+	sample, found := p.samples[key]
+	if !found {
+		sample = &profileSample{stack: p.pending}
+		p.samples[key] = sample
+	}
+	sample.count++
+	sample.nanos += now.Sub(p.started).Nanoseconds()
+	p.pending = nil
+}
+
+// frames names the function of every entry in a sample's stack (leaf first).
+// The bottom frame is the top level program, every other frame is the function its instruction belongs to,
+// which is what the CALL below it called even when it went through a reference
+func (p *Profiler) frames(stack []int) []string {
+	names := make([]string, len(stack))
+	for i := range stack {
+		if i == len(stack)-1 || p.owners[stack[i]] == "" {
+			names[i] = "main"
+		} else {
+			names[i] = p.owners[stack[i]]
+		}
+	}
+	return names
+}
+
+type functionProfile struct {
+	name       string
+	calls      int
+	selfCount  int64
+	selfNanos  int64
+	totalCount int64
+	totalNanos int64
+}
+
+type positionProfile struct {
+	index int
+	count int64
+	nanos int64
+}
+
+func (p *Profiler) summarize() ([]*functionProfile, []*positionProfile) {
+	functions := make(map[string]*functionProfile)
+	positions := make(map[int]*positionProfile)
+	get := func(name string) *functionProfile {
+		if functions[name] == nil {
+			functions[name] = &functionProfile{name: name, calls: p.calls[name]}
+		}
+		return functions[name]
+	}
+
+	for _, sample := range p.samples {
+		names := p.frames(sample.stack)
+		self := get(names[0])
+		self.selfCount += sample.count
+		self.selfNanos += sample.nanos
+
+		// recursive functions only count once per sample towards their inclusive totals
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fn := get(name)
+			fn.totalCount += sample.count
+			fn.totalNanos += sample.nanos
+		}
+
+		pos := positions[sample.stack[0]]
+		if pos == nil {
+			pos = &positionProfile{index: sample.stack[0]}
+			positions[sample.stack[0]] = pos
+		}
+		pos.count += sample.count
+		pos.nanos += sample.nanos
+	}
+
+	var fns []*functionProfile
+	for _, fn := range functions {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		if fns[i].totalNanos != fns[j].totalNanos {
+			return fns[i].totalNanos > fns[j].totalNanos
+		}
+		return fns[i].name < fns[j].name
+	})
+	var pos []*positionProfile
+	for _, position := range positions {
+		pos = append(pos, position)
+	}
+	sort.Slice(pos, func(i, j int) bool {
+		if pos[i].nanos != pos[j].nanos {
+			return pos[i].nanos > pos[j].nanos
+		}
+		return pos[i].index < pos[j].index
+	})
+	return fns, pos
+}
+
+// WriteReport prints the per function and per instruction breakdown, hottest first
+func (p *Profiler) WriteReport(w io.Writer, top int) error {
+	fns, positions := p.summarize()
+	var totalCount, totalNanos int64
+	for _, sample := range p.samples {
+		totalCount += sample.count
+		totalNanos += sample.nanos
+	}
+	percent := func(nanos int64) string {
+		if totalNanos == 0 {
+			return "0.0%"
+		}
+		return fmt.Sprintf("%.1f%%", float64(nanos)*100/float64(totalNanos))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Profile: %d instructions executed in %v\n\n", totalCount, time.Duration(totalNanos))
+	fmt.Fprintln(tw, "FUNCTION\tCALLS\tSELF COUNT\tSELF TIME\tSELF%\tTOTAL COUNT\tTOTAL TIME\tTOTAL%\t")
+	for _, fn := range fns {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%s\t%d\t%v\t%s\t\n", fn.name, fn.calls, fn.selfCount, time.Duration(fn.selfNanos), percent(fn.selfNanos),
+			fn.totalCount, time.Duration(fn.totalNanos), percent(fn.totalNanos))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDX\tLINE\tFUNCTION\tINSTRUCTION\tCOUNT\tTIME\tTIME%")
+	for i, pos := range positions {
+		if top > 0 && i >= top {
+			break
+		}
+		inst := p.program[pos.index]
+		owner := p.owners[pos.index]
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%v\t%s\n", pos.index, inst.Location(), owner, inst, pos.count, time.Duration(pos.nanos), percent(pos.nanos))
+	}
+	return tw.Flush()
+}
+
+// WritePprof writes the profile as a gzipped profile.proto, readable by `go tool pprof`.
+// Every CWheel position is a location, every DEF (and the top level) a function
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := []string{""}
+	strIndex := map[string]int{"": 0}
+	str := func(s string) uint64 {
+		if i, found := strIndex[s]; found {
+			return uint64(i)
+		}
+		strIndex[s] = len(strs)
+		strs = append(strs, s)
+		return uint64(len(strs) - 1)
+	}
+
+	var out protoBuffer
+	valueType := func(field int, typ, unit string) {
+		var vt protoBuffer
+		vt.uint(1, str(typ))
+		vt.uint(2, str(unit))
+		out.bytes(field, vt)
+	}
+	valueType(1, "instructions", "count")
+	valueType(1, "time", "nanoseconds")
+
+	functionIDs := make(map[string]uint64)
+	var functionOrder []string
+	functionID := func(name string) uint64 {
+		if id, found := functionIDs[name]; found {
+			return id
+		}
+		functionIDs[name] = uint64(len(functionOrder) + 1)
+		functionOrder = append(functionOrder, name)
+		return functionIDs[name]
+	}
+	type locationKey struct {
+		index    int
+		function string
+	}
+	locationIDs := make(map[locationKey]uint64)
+	var locationOrder []locationKey
+	locationID := func(key locationKey) uint64 {
+		if id, found := locationIDs[key]; found {
+			return id
+		}
+		functionID(key.function)
+		locationIDs[key] = uint64(len(locationOrder) + 1)
+		locationOrder = append(locationOrder, key)
+		return locationIDs[key]
+	}
+
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sample := p.samples[key]
+		names := p.frames(sample.stack)
+		var ids []uint64
+		for i, index := range sample.stack {
+			ids = append(ids, locationID(locationKey{index: index, function: names[i]}))
+		}
+		var s protoBuffer
+		s.packedUint(1, ids)
+		s.packedInt(2, []int64{sample.count, sample.nanos})
+		out.bytes(2, s)
+	}
+
+	for _, key := range locationOrder {
+		var line protoBuffer
+		line.uint(1, functionIDs[key.function])
+		line.int(2, int64(p.program[key.index].Line+1))
+		var loc protoBuffer
+		loc.uint(1, locationIDs[key])
+		loc.uint(3, uint64(key.index))
+		loc.bytes(4, line)
+		out.bytes(4, loc)
+	}
+
+	defLines := make(map[string]int64)
+	files := map[string]string{"main": p.path}
+	for _, inst := range p.program {
+		if inst.Mnemonic == "DEF" {
+			defLines[inst.ArgumentStr] = int64(inst.Line + 1)
+			files[inst.ArgumentStr] = p.path
+			if inst.File != "" {
+				files[inst.ArgumentStr] = inst.File
+			}
+		}
+	}
+	for i, name := range functionOrder {
+		var fn protoBuffer
+		fn.uint(1, uint64(i+1))
+		fn.uint(2, str(name))
+		fn.uint(3, str(name))
+		fn.uint(4, str(files[name]))
+		fn.int(5, defLines[name])
+		out.bytes(5, fn)
+	}
+
+	// the string table has to be complete before it is written
+	timeNanos := p.began.UnixNano()
+	duration := p.ended.Sub(p.began).Nanoseconds()
+	var period protoBuffer
+	period.uint(1, str("time"))
+	period.uint(2, str("nanoseconds"))
+	for _, s := range strs {
+		out.string(6, s)
+	}
+	out.int(9, timeNanos)
+	out.int(10, duration)
+	out.bytes(11, period)
+	out.int(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoBuffer is just enough protobuf wire format to write a pprof profile
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuffer) uint(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuffer) packedUint(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytes(field, packed)
+}
+
+func (b *protoBuffer) packedInt(field int, values []int64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(uint64(v))
+	}
+	b.bytes(field, packed)
+}
+
+// profileKey identifies a call stack in Profiler.samples
+func profileKey(stack []int) string {
+	parts := make([]string, len(stack))
+	for i, index := range stack {
+		parts[i] = strconv.Itoa(index)
+	}
+	return strings.Join(parts, ",")
+}
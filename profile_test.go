@@ -0,0 +1,86 @@
+package twist
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProfileCounts(t *testing.T) {
+	const source = `DEF "inc" 1
+ADD 1
+ADDARG
+RET
+NEWV 0
+ADDARG
+CALL "inc" %
+OUT "skipped"
+CALL "inc" %
+OUT "skipped"
+`
+	instructions, err := parseProgram(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProfiler(instructions, "")
+	vm := NewVM(instructions)
+	vm.profiler = p
+	vm.Run()
+
+	fns, positions := p.summarize()
+	counts := make(map[int]int64)
+	for _, pos := range positions {
+		counts[pos.index] = pos.count
+	}
+	// DEF jumps over the body, which then runs once per CALL, and the instructions after a CALL are skipped
+	want := map[int]int64{0: 1, 1: 2, 2: 2, 3: 2, 4: 1, 5: 1, 6: 1, 8: 1}
+	if len(counts) != len(want) {
+		t.Errorf("positions %v, want %v", counts, want)
+	}
+	for index, count := range want {
+		if counts[index] != count {
+			t.Errorf("position %d ran %d times, want %d", index, counts[index], count)
+		}
+	}
+
+	byName := make(map[string]*functionProfile)
+	for _, fn := range fns {
+		byName[fn.name] = fn
+	}
+	inc, main := byName["inc"], byName["main"]
+	if inc == nil || main == nil || len(byName) != 2 {
+		t.Fatalf("functions %v, want inc and main", byName)
+	}
+	if inc.calls != 2 || inc.selfCount != 6 || inc.totalCount != 6 {
+		t.Errorf("inc was called %d times running %d instructions itself and %d in total, want 2, 6 and 6",
+			inc.calls, inc.selfCount, inc.totalCount)
+	}
+	// main includes the instructions inc ran on its behalf
+	if main.selfCount != 5 || main.totalCount != 11 {
+		t.Errorf("main ran %d instructions itself and %d in total, want 5 and 11", main.selfCount, main.totalCount)
+	}
+}
+
+func TestProfileCall(t *testing.T) {
+	vm, _ := loadSource(t, "DEF \"inc\" 1\nADD 1\nADDARG\nRET\n")
+	p := NewProfiler(vm.Program(), "")
+	vm.SetProfiler(p)
+	for i := 0; i < 3; i++ {
+		if _, err := vm.Call("inc", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every sample's stack has the frame Call pushed under it, which used to point before the program
+	var out bytes.Buffer
+	if err := p.WritePprof(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteReport(&out, 10); err != nil {
+		t.Fatal(err)
+	}
+	fns, _ := p.summarize()
+	for _, fn := range fns {
+		if fn.name == "inc" && fn.selfCount != 9 {
+			t.Errorf("inc ran %d instructions itself, want 9", fn.selfCount)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package twist
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduler runs every thread of a program on the goroutine that called Run instead of a goroutine each,
+// one instruction at a time. Round robin gives every thread a turn in the order they were spawned,
+// a seeded one picks the next thread at random, so the same seed always interleaves them the same way
+// and a race it turns up can be run again. A thread waiting on SEND, RECV or JOIN isn't picked until
+// another thread wakes it
+type Scheduler struct {
+	rng  *rand.Rand // nil for round robin
+	seed int64
+	// last is the id of the thread that ran last, round robin carries on after it
+	last int
+}
+
+func NewRoundRobinScheduler() *Scheduler {
+	return &Scheduler{last: -1}
+}
+
+func NewSeededScheduler(seed int64) *Scheduler {
+	return &Scheduler{rng: rand.New(rand.NewSource(seed)), seed: seed, last: -1}
+}
+
+// next picks the thread to run an instruction of, nil if none of them can
+func (s *Scheduler) next(threads []*VM) *VM {
+	if s.rng == nil {
+		for i := 1; i <= len(threads); i++ {
+			t := threads[mod(s.last+i, len(threads))]
+			if t.runnable() {
+				s.last = t.id
+				return t
+			}
+		}
+		return nil
+	}
+	var runnable []*VM
+	for _, t := range threads {
+		if t.runnable() {
+			runnable = append(runnable, t)
+		}
+	}
+	if len(runnable) == 0 {
+		return nil
+	}
+	t := runnable[s.rng.Intn(len(runnable))]
+	s.last = t.id
+	return t
+}
+
+// String is the --schedule flag that gives the same interleaving again
+func (s *Scheduler) String() string {
+	if s.rng == nil {
+		return "roundrobin"
+	}
+	return fmt.Sprintf("random:%d", s.seed)
+}
+
+// ParseSchedule turns a --schedule flag into a scheduler: "threads" (goroutines, the nil scheduler),
+// "roundrobin", "random:seed", or "random" for a seed from the time
+func ParseSchedule(mode string) (*Scheduler, error) {
+	switch mode {
+	case "", "threads":
+		return nil, nil
+	case "roundrobin":
+		return NewRoundRobinScheduler(), nil
+	case "random":
+		return NewSeededScheduler(time.Now().UnixNano()), nil
+	}
+	if seed, found := strings.CutPrefix(mode, "random:"); found {
+		if n, err := strconv.ParseInt(seed, 10, 64); err == nil {
+			return NewSeededScheduler(n), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown schedule %q, use threads, roundrobin, random or random:seed", mode)
+}
+
+// Schedule runs the program's threads with s rather than on goroutines, nil goes back to goroutines.
+// It has to be picked before the program SPAWNs anything
+func (vm *VM) Schedule(s *Scheduler) {
+	vm.group.scheduler = s
+}
+
+// runnable reports whether a thread can be picked, it hasn't returned and isn't waiting
+func (vm *VM) runnable() bool {
+	return !vm.finished && !vm.waiting
+}
+
+// runScheduled is Run with a Scheduler, the program and every thread it spawns take turns on this goroutine.
+// The program ending ends them all, like it does for goroutines
+func (vm *VM) runScheduled() {
+	g := vm.group
+	for vm.C.cursor < len(vm.C.data) {
+		if vm.halt.Load() {
+			vm.halt.Store(false)
+			vm.paused = true
+			return
+		}
+		t := g.scheduler.next(g.threads)
+		if t == nil {
+			return
+		}
+		if !t.Step() {
+			if t == vm {
+				return
+			}
+			t.finished = true
+			g.wake()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package twist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Session records everything nondeterministic about a run (INP responses, DEL timings and TIME readings),
+// plus the output it produced, as one JSON event per line. Replaying a session feeds the same
+// input back without sleeping, and checks the output comes out byte for byte the same
+type Session struct {
+	replaying bool
+
+	// recording
+	encoder *json.Encoder
+	err     error
+
+	// replaying
+	events    []sessionEvent
+	next      int
+	actual    map[string]*bytes.Buffer
+	divergent string
+}
+
+type sessionEvent struct {
+	Event   string `json:"event"`
+	Program string `json:"program,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Stream  string `json:"stream,omitempty"`
+	Millis  int64  `json:"ms,omitempty"`
+}
+
+func RecordSession(w io.Writer, program string) *Session {
+	s := &Session{encoder: json.NewEncoder(w)}
+	s.write(sessionEvent{Event: "start", Program: program})
+	return s
+}
+
+func ReplaySession(r io.Reader) (*Session, error) {
+	s := &Session{replaying: true, actual: make(map[string]*bytes.Buffer)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var event sessionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("bad session event %d: %v", len(s.events)+1, err)
+		}
+		s.events = append(s.events, event)
+	}
+	return s, scanner.Err()
+}
+
+// Program is the path of the program the session was recorded with
+func (s *Session) Program() string {
+	for _, event := range s.events {
+		if event.Event == "start" {
+			return event.Program
+		}
+	}
+	return ""
+}
+
+// Attach wires a VM up to the session, wrapping its output so it gets recorded or checked.
+// A replay runs on a SkipClock so DEL doesn't sleep
+func (s *Session) Attach(vm *VM) {
+	vm.session = s
+	if s.replaying {
+		vm.clock = NewSkipClock()
+	}
+	vm.stdout = s.wrap("stdout", vm.stdout)
+	vm.stderr = s.wrap("stderr", vm.stderr)
+}
+
+func (s *Session) wrap(stream string, w io.Writer) io.Writer {
+	if s.replaying {
+		s.actual[stream] = &bytes.Buffer{}
+		return io.MultiWriter(w, s.actual[stream])
+	}
+	return io.MultiWriter(w, sessionStream{s, stream})
+}
+
+type sessionStream struct {
+	s      *Session
+	stream string
+}
+
+func (w sessionStream) Write(p []byte) (int, error) {
+	w.s.write(sessionEvent{Event: "output", Stream: w.stream, Data: string(p)})
+	return len(p), nil
+}
+
+func (s *Session) write(event sessionEvent) {
+	if s.err == nil {
+		s.err = s.encoder.Encode(event)
+	}
+}
+
+func (s *Session) recordInput(line string) {
+	s.write(sessionEvent{Event: "input", Data: line})
+}
+
+// take returns the next input, sleep or time event, output is only there to check against at the end
+func (s *Session) take(kind string) (sessionEvent, bool) {
+	for s.next < len(s.events) {
+		event := s.events[s.next]
+		s.next++
+		switch event.Event {
+		case "input", "sleep", "time":
+			if event.Event != kind {
+				s.diverge(fmt.Sprintf("program asked for %s but the session has %s next (event %d)", kind, event.Event, s.next))
+				return sessionEvent{}, false
+			}
+			return event, true
+		}
+	}
+	s.diverge(fmt.Sprintf("program asked for %s after the end of the session", kind))
+	return sessionEvent{}, false
+}
+
+func (s *Session) diverge(message string) {
+	if s.divergent == "" {
+		s.divergent = message
+	}
+}
+
+func (s *Session) input() (string, error) {
+	event, ok := s.take("input")
+	if !ok {
+		return "", io.EOF
+	}
+	return event.Data, nil
+}
+
+// delay records a DEL, or checks it against the recording
+func (s *Session) delay(d time.Duration) {
+	if !s.replaying {
+		s.write(sessionEvent{Event: "sleep", Millis: d.Milliseconds()})
+		return
+	}
+	event, ok := s.take("sleep")
+	if ok && event.Millis != d.Milliseconds() {
+		s.diverge(fmt.Sprintf("DEL %d where the session recorded DEL %d (event %d)", d.Milliseconds(), event.Millis, s.next))
+	}
+}
+
+// elapsed records what TIME read from the clock, a replay reads back the recorded value instead
+func (s *Session) elapsed(d time.Duration) time.Duration {
+	if !s.replaying {
+		s.write(sessionEvent{Event: "time", Millis: d.Milliseconds()})
+		return d
+	}
+	if event, ok := s.take("time"); ok {
+		return time.Duration(event.Millis) * time.Millisecond
+	}
+	return d
+}
+
+// Close finishes a recording, or for a replay reports the first place it stopped matching the recording
+func (s *Session) Close() error {
+	if !s.replaying {
+		s.write(sessionEvent{Event: "end"})
+		return s.err
+	}
+	if s.divergent != "" {
+		return fmt.Errorf("replay diverged: %s", s.divergent)
+	}
+	expected := make(map[string]*bytes.Buffer)
+	for _, event := range s.events {
+		if event.Event == "output" {
+			if expected[event.Stream] == nil {
+				expected[event.Stream] = &bytes.Buffer{}
+			}
+			expected[event.Stream].WriteString(event.Data)
+		}
+	}
+	for _, stream := range []string{"stdout", "stderr"} {
+		want, got := "", ""
+		if expected[stream] != nil {
+			want = expected[stream].String()
+		}
+		if s.actual[stream] != nil {
+			got = s.actual[stream].String()
+		}
+		if want != got {
+			return fmt.Errorf("replay diverged: %s differs from the recording at byte %d", stream, firstDifference(want, got))
+		}
+	}
+	return nil
+}
+
+func firstDifference(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,62 @@
+package twist
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReplayMatchesRecording(t *testing.T) {
+	// what INP reads and what TIME reads after a real DEL differ from run to run, the replay gets them from the recording
+	const source = `NEWV 0
+INP "name?"
+OUT
+DEL 5
+TIME
+OUT
+OUT "done"
+`
+	// run runs source attached to session, with input waiting on stdin
+	run := func(source, input string, session *Session) string {
+		vm, out := loadSource(t, source)
+		vm.stdin = bufio.NewReader(strings.NewReader(input))
+		session.Attach(vm)
+		vm.Run()
+		return out.String()
+	}
+
+	var recording bytes.Buffer
+	session := RecordSession(&recording, "test.whl")
+	recorded := run(source, "ada\n", session)
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func(source string) (string, error) {
+		session, err := ReplaySession(bytes.NewReader(recording.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := run(source, "someone else\n", session)
+		return out, session.Close()
+	}
+	out, err := replay(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != recorded {
+		t.Errorf("replay printed %q, the recording printed %q", out, recorded)
+	}
+	if !strings.HasPrefix(out, "name?\nada \n") {
+		t.Errorf("replay printed %q, want the recorded input", out)
+	}
+
+	// a program that has changed since the recording is caught
+	if _, err := replay(strings.Replace(source, "DEL 5", "DEL 6", 1)); err == nil || !strings.Contains(err.Error(), "DEL 6") {
+		t.Errorf("replaying with a different DEL returned %v", err)
+	}
+	if _, err := replay(strings.Replace(source, `OUT "done"`, `OUT "finished"`, 1)); err == nil || !strings.Contains(err.Error(), "stderr") {
+		t.Errorf("replaying with different output returned %v", err)
+	}
+}
@@ -0,0 +1,431 @@
+package twist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// snapshotVersion goes up whenever the format gains something an older Restore wouldn't know to read:
+// 2 added named wheels, 3 generators, 4 nested wheels, 5 maps and 6 generator ids. Every older version is still read
+const snapshotVersion = 6
+
+// Snapshot is the whole machine in a form that survives a round trip through JSON:
+// the program, the CWheel, every VWheel on the dataStack, the named wheels, the generators, the call stack and the argument stack.
+// Wheels and maps held in cells are saved once each in Nested and Maps and cells refer to them by index,
+// so a wheel in two places is still one wheel when restored
+type Snapshot struct {
+	Version    int                      `json:"version"`
+	Program    []Instruction            `json:"program"`
+	CWheel     snapshotCWheel           `json:"cwheel"`
+	Wheels     []snapshotWheel          `json:"wheels"`
+	Named      map[string]snapshotWheel `json:"named,omitempty"`
+	Generators []snapshotGenerator      `json:"generators,omitempty"`
+	LastGen    int                      `json:"last_generator,omitempty"`
+	CallStack  []int                    `json:"call_stack"`
+	Args       []snapshotValue          `json:"args"`
+	Nested     []snapshotWheel          `json:"nested,omitempty"`
+	Maps       [][]snapshotEntry        `json:"maps,omitempty"`
+}
+
+type snapshotCWheel struct {
+	Cursor int `json:"cursor"`
+	Dir    int `json:"dir"`
+}
+
+type snapshotWheel struct {
+	Cursor    int             `json:"cursor"`
+	Dir       int             `json:"dir"`
+	CMPFLAG   bool            `json:"cmpflag"`
+	Data      []snapshotValue `json:"data"`
+	Active    string          `json:"active,omitempty"`
+	Entered   []int           `json:"entered,omitempty"`
+	Generator int             `json:"generator,omitempty"`
+}
+
+// snapshotGenerator is a generator between RESUMEs, a running one has its frame on the dataStack instead.
+// Before version 6 a generator's id was its place in the list, and finished ones stayed in it marked Done
+type snapshotGenerator struct {
+	ID      int           `json:"id"`
+	Wheel   snapshotWheel `json:"wheel"`
+	Cursor  int           `json:"cursor"`
+	Running bool          `json:"running,omitempty"`
+	Done    bool          `json:"done,omitempty"`
+}
+
+// snapshotValue keeps the kind of a cell, JSON alone can't tell 2 from 2.0.
+// Wheel is an index into Snapshot.Nested and Map one into Snapshot.Maps
+type snapshotValue struct {
+	Int   *int     `json:"int,omitempty"`
+	Float *float64 `json:"float,omitempty"`
+	Str   *string  `json:"str,omitempty"`
+	Wheel *int     `json:"wheel,omitempty"`
+	Map   *int     `json:"map,omitempty"`
+}
+
+type snapshotEntry struct {
+	Key   snapshotValue `json:"key"`
+	Value snapshotValue `json:"value"`
+}
+
+// nestedValues collects the wheels and maps held in cells while encoding, the indexes give each one its place
+type nestedValues struct {
+	wheelIndex map[*shared]int
+	wheels     []snapshotWheel
+	mapIndex   map[*shared]int
+	maps       [][]snapshotEntry
+}
+
+// restoredValues are the wheels and maps of a snapshot, made before any cell that refers to them is decoded
+type restoredValues struct {
+	wheels []*shared
+	maps   []*shared
+}
+
+func (t *nestedValues) encodeValue(v Value) (snapshotValue, error) {
+	switch v.Kind() {
+	case KindInt:
+		n, _ := v.Int()
+		return snapshotValue{Int: &n}, nil
+	case KindFloat:
+		f, _ := v.Float()
+		return snapshotValue{Float: &f}, nil
+	case KindString:
+		s, _ := v.Str()
+		return snapshotValue{Str: &s}, nil
+	case KindWheel:
+		i, found := t.wheelIndex[v.p]
+		if !found {
+			// the place is taken before encoding the cells, so a wheel that holds itself finds it
+			i = len(t.wheels)
+			t.wheelIndex[v.p] = i
+			t.wheels = append(t.wheels, snapshotWheel{})
+			encoded, err := t.encodeWheel(v.p.wheel)
+			if err != nil {
+				return snapshotValue{}, err
+			}
+			t.wheels[i] = encoded
+		}
+		return snapshotValue{Wheel: &i}, nil
+	case KindMap:
+		i, found := t.mapIndex[v.p]
+		if !found {
+			i = len(t.maps)
+			t.mapIndex[v.p] = i
+			t.maps = append(t.maps, nil)
+			// sorted, so the same map always saves the same way
+			entries := []snapshotEntry{}
+			for _, key := range sortedKeys(v.p.entries) {
+				k, err := t.encodeValue(key)
+				if err != nil {
+					return snapshotValue{}, err
+				}
+				item, err := t.encodeValue(v.p.entries[key])
+				if err != nil {
+					return snapshotValue{}, err
+				}
+				entries = append(entries, snapshotEntry{Key: k, Value: item})
+			}
+			t.maps[i] = entries
+		}
+		return snapshotValue{Map: &i}, nil
+	}
+	return snapshotValue{}, fmt.Errorf("can't snapshot value %v of kind %s", v, v.Kind())
+}
+
+// decode turns a snapshotValue back into a Value
+func (v snapshotValue) decode(nested *restoredValues) (Value, error) {
+	switch {
+	case v.Int != nil:
+		return IntValue(*v.Int), nil
+	case v.Float != nil:
+		return FloatValue(*v.Float), nil
+	case v.Str != nil:
+		return StringValue(*v.Str), nil
+	case v.Wheel != nil:
+		if *v.Wheel < 0 || *v.Wheel >= len(nested.wheels) {
+			return Value{}, fmt.Errorf("nested wheel %d isn't in the snapshot", *v.Wheel)
+		}
+		return Value{kind: KindWheel, p: nested.wheels[*v.Wheel]}, nil
+	case v.Map != nil:
+		if *v.Map < 0 || *v.Map >= len(nested.maps) {
+			return Value{}, fmt.Errorf("map %d isn't in the snapshot", *v.Map)
+		}
+		return Value{kind: KindMap, p: nested.maps[*v.Map]}, nil
+	}
+	return Value{}, fmt.Errorf("empty value in snapshot")
+}
+
+func (t *nestedValues) encodeValues(values []Value) ([]snapshotValue, error) {
+	out := make([]snapshotValue, len(values))
+	for i, v := range values {
+		encoded, err := t.encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = encoded
+	}
+	return out, nil
+}
+
+func decodeValues(values []snapshotValue, nested *restoredValues) ([]Value, error) {
+	out := make([]Value, len(values))
+	for i, v := range values {
+		decoded, err := v.decode(nested)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = decoded
+	}
+	return out, nil
+}
+
+func (t *nestedValues) encodeWheel(wheel VWheel) (snapshotWheel, error) {
+	data, err := t.encodeValues(wheel.data)
+	if err != nil {
+		return snapshotWheel{}, err
+	}
+	return snapshotWheel{Cursor: wheel.cursor, Dir: wheel.dir, CMPFLAG: wheel.CMPFLAG, Data: data, Active: wheel.active, Entered: wheel.entered, Generator: wheel.generator}, nil
+}
+
+func (w snapshotWheel) decode(what string, nested *restoredValues) (VWheel, error) {
+	data, err := decodeValues(w.Data, nested)
+	if err != nil {
+		return VWheel{}, err
+	}
+	if len(data) > 0 && (w.Cursor < 0 || w.Cursor >= len(data)) {
+		return VWheel{}, fmt.Errorf("%s cursor %d is outside its data", what, w.Cursor)
+	}
+	if w.Dir != 1 && w.Dir != -1 {
+		return VWheel{}, fmt.Errorf("%s direction %d isn't 1 or -1", what, w.Dir)
+	}
+	// a path can go stale when a cell on it is overwritten, enteredWheel stops there, but a step is never negative
+	for _, step := range w.Entered {
+		if step < 0 {
+			return VWheel{}, fmt.Errorf("%s has entered cell %d", what, step)
+		}
+	}
+	return VWheel{cursor: w.Cursor, data: data, dir: w.Dir, CMPFLAG: w.CMPFLAG, active: w.Active, entered: w.Entered, generator: w.Generator}, nil
+}
+
+// Snapshot captures the VM between instructions, usually after Stop has paused Run
+func (vm *VM) Snapshot() (*Snapshot, error) {
+	if vm.group.spawned() {
+		return nil, fmt.Errorf("can't snapshot a program that has SPAWNed threads")
+	}
+	s := &Snapshot{
+		Version:   snapshotVersion,
+		Program:   append([]Instruction(nil), vm.C.data...),
+		CWheel:    snapshotCWheel{Cursor: vm.C.cursor, Dir: vm.C.dir},
+		CallStack: append([]int{}, vm.callStack...),
+	}
+	t := &nestedValues{wheelIndex: make(map[*shared]int), mapIndex: make(map[*shared]int)}
+	for _, wheel := range vm.dataStack {
+		encoded, err := t.encodeWheel(wheel)
+		if err != nil {
+			return nil, err
+		}
+		s.Wheels = append(s.Wheels, encoded)
+	}
+	for name, wheel := range vm.named {
+		encoded, err := t.encodeWheel(*wheel)
+		if err != nil {
+			return nil, err
+		}
+		if s.Named == nil {
+			s.Named = make(map[string]snapshotWheel)
+		}
+		s.Named[name] = encoded
+	}
+	// in id order, so the same VM always saves the same snapshot
+	ids := make([]int, 0, len(vm.generators))
+	for id := range vm.generators {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		gen := vm.generators[id]
+		encoded, err := t.encodeWheel(gen.wheel)
+		if err != nil {
+			return nil, err
+		}
+		s.Generators = append(s.Generators, snapshotGenerator{ID: id, Wheel: encoded, Cursor: gen.cursor, Running: gen.running})
+	}
+	s.LastGen = vm.lastGenerator
+	args, err := t.encodeValues(vm.args)
+	if err != nil {
+		return nil, err
+	}
+	s.Args = args
+	s.Nested = t.wheels
+	s.Maps = t.maps
+	return s, nil
+}
+
+// Restore replaces the state of the VM with a snapshot, calling Run afterwards carries on from where it was taken
+func (vm *VM) Restore(s *Snapshot) error {
+	if s.Version < 1 || s.Version > snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, this build reads 1 to %d", s.Version, snapshotVersion)
+	}
+	if len(s.Wheels) == 0 {
+		return fmt.Errorf("snapshot has no VWheels")
+	}
+	if s.CWheel.Cursor < 0 || s.CWheel.Cursor > len(s.Program) {
+		return fmt.Errorf("CWheel cursor %d is outside the program", s.CWheel.Cursor)
+	}
+	// 0 is the direction a program starts in, before any WHLDIRC
+	if s.CWheel.Dir < -1 || s.CWheel.Dir > 1 {
+		return fmt.Errorf("CWheel direction %d isn't 1, 0 or -1", s.CWheel.Dir)
+	}
+	for _, addr := range s.CallStack {
+		if addr < 0 || addr > len(s.Program) {
+			return fmt.Errorf("return address %d is outside the program", addr)
+		}
+	}
+
+	// every nested wheel and map is made before any cells are decoded, a cell can refer to one that comes later
+	nested := &restoredValues{wheels: make([]*shared, len(s.Nested)), maps: make([]*shared, len(s.Maps))}
+	for i := range nested.wheels {
+		nested.wheels[i] = &shared{}
+	}
+	for i := range nested.maps {
+		nested.maps[i] = &shared{entries: make(valueMap, len(s.Maps[i]))}
+	}
+	for i, w := range s.Nested {
+		wheel, err := w.decode(fmt.Sprintf("nested wheel %d", i), nested)
+		if err != nil {
+			return err
+		}
+		nested.wheels[i].wheel = wheel
+	}
+	for i, entries := range s.Maps {
+		for _, entry := range entries {
+			key, err := entry.Key.decode(nested)
+			if err != nil {
+				return err
+			}
+			if !key.IsKey() {
+				return fmt.Errorf("map %d has %v as a key", i, key)
+			}
+			value, err := entry.Value.decode(nested)
+			if err != nil {
+				return err
+			}
+			nested.maps[i].entries[key] = value
+		}
+	}
+	var wheels []VWheel
+	for i, w := range s.Wheels {
+		wheel, err := w.decode(fmt.Sprintf("VWheel %d", i), nested)
+		if err != nil {
+			return err
+		}
+		if _, found := s.Named[wheel.active]; wheel.active != "" && !found {
+			return fmt.Errorf("VWheel %d uses a wheel named '%s' that isn't in the snapshot", i, wheel.active)
+		}
+		wheels = append(wheels, wheel)
+	}
+	generators := make(map[int]*generator)
+	lastGen := s.LastGen
+	if s.Version < 6 {
+		lastGen = len(s.Generators)
+	}
+	for i, g := range s.Generators {
+		id := g.ID
+		if s.Version < 6 {
+			id = i + 1
+		}
+		if id < 1 || id > lastGen || generators[id] != nil {
+			return fmt.Errorf("generator %d is repeated or past the last id handed out, %d", id, lastGen)
+		}
+		if g.Done {
+			continue
+		}
+		// a running generator's frame is on the stack, its wheel is empty
+		var wheel VWheel
+		if !g.Running {
+			var err error
+			if wheel, err = g.Wheel.decode(fmt.Sprintf("generator %d", id), nested); err != nil {
+				return err
+			}
+		}
+		if g.Cursor < 0 || g.Cursor > len(s.Program) {
+			return fmt.Errorf("generator %d cursor %d is outside the program", id, g.Cursor)
+		}
+		generators[id] = &generator{wheel: wheel, cursor: g.Cursor, running: g.Running}
+	}
+	for i, wheel := range wheels {
+		if _, found := generators[wheel.generator]; wheel.generator != 0 && !found {
+			return fmt.Errorf("VWheel %d belongs to generator %d that isn't in the snapshot", i, wheel.generator)
+		}
+	}
+	named := make(map[string]*VWheel)
+	for name, w := range s.Named {
+		wheel, err := w.decode(fmt.Sprintf("wheel '%s'", name), nested)
+		if err != nil {
+			return err
+		}
+		named[name] = &wheel
+	}
+	args, err := decodeValues(s.Args, nested)
+	if err != nil {
+		return err
+	}
+
+	program := append([]Instruction(nil), s.Program...)
+	vm.functions = collectFunctions(program)
+	vm.C = CWheel{cursor: s.CWheel.Cursor, data: program, code: decodeProgram(program, vm.functions), dir: s.CWheel.Dir}
+	vm.dataStack = wheels
+	vm.named = named
+	vm.generators = generators
+	vm.lastGenerator = lastGen
+	vm.callStack = append([]int{}, s.CallStack...)
+	vm.args = args
+	vm.programEnd = programLength(vm.C.data)
+	vm.group.end()
+	scheduler := vm.group.scheduler
+	vm.group = newThreadGroup(vm)
+	vm.group.scheduler = scheduler
+	return nil
+}
+
+func ParseSnapshot(data []byte) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SaveSnapshot writes a snapshot of vm to path as indented JSON
+func SaveSnapshot(vm *VM, path string) error {
+	s, err := vm.Snapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadSnapshot reads a snapshot written by SaveSnapshot, without restoring it
+func ReadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSnapshot(data)
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot into a new VM, ready to Run
+func LoadSnapshot(path string) (*VM, error) {
+	s, err := ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	vm := NewVM(nil)
+	return vm, vm.Restore(s)
+}
@@ -0,0 +1,167 @@
+package twist
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	// a named wheel holding a map and a nested wheel, a CALL and a generator part way through
+	const source = `WHEEL "log"
+DEF "countdown" 1
+YIELD
+ADD -1
+CMP 0
+JIZ -2
+JMP 4
+RET
+DEF "record" 1
+PUT "log"
+RET
+USE "log"
+NEWM
+NEWV "k"
+NEWV 7
+MPUT
+MOVVW -1
+NEST
+ENTER
+NEWV 1
+EXIT
+USE
+NEWV 3
+ADDARG
+GEN "countdown" %
+MOVVW 1
+RESUME
+JIZ -9
+MOVVW -2
+OUT
+ADDARG
+CALL "record" %
+OUT "skipped"
+MOVVW 2
+JMP 8
+OUT "unreached"
+OUT "done"
+USE "log"
+OUT
+MOVVW 1
+OUT
+MOVVW 1
+OUT
+MOVVW 1
+OUT
+MOVVW 1
+OUT
+`
+	want := runSource(t, source)
+	if want != "3 \n2 \n1 \ndone\n{1} \n3 \n2 \n1 \n(k:7) \n" {
+		t.Fatalf("uninterrupted run printed %q", want)
+	}
+
+	// stop after every instruction in turn, the snapshot goes through JSON like --save and --resume
+	for steps := 0; ; steps++ {
+		vm, out := loadSource(t, source)
+		ran := 0
+		for ran < steps && vm.Step() {
+			ran++
+		}
+		if ran < steps {
+			break
+		}
+		s, err := vm.Snapshot()
+		if err != nil {
+			t.Fatalf("snapshot after %d steps: %v", steps, err)
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("snapshot after %d steps: %v", steps, err)
+		}
+		if s, err = ParseSnapshot(data); err != nil {
+			t.Fatalf("snapshot after %d steps: %v", steps, err)
+		}
+		restored := NewVM(nil)
+		if err := restored.Restore(s); err != nil {
+			t.Fatalf("restoring after %d steps: %v", steps, err)
+		}
+		rest := new(bytes.Buffer)
+		restored.SetOutput(rest, rest)
+		restored.Run()
+		if got := out.String() + rest.String(); got != want {
+			t.Errorf("resumed after %d steps, printed %q, want %q", steps, got, want)
+		}
+	}
+}
+
+func TestRestoreRejectsBadSnapshots(t *testing.T) {
+	vm, _ := loadSource(t, "NEWV 0\nNEST\nENTER\nNEWV 1\n")
+	for vm.Step() {
+	}
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		edit  func(s *Snapshot)
+		error string
+	}{
+		{"version 0", func(s *Snapshot) { s.Version = 0 }, "unsupported snapshot version"},
+		{"a newer version", func(s *Snapshot) { s.Version = snapshotVersion + 1 }, "unsupported snapshot version"},
+		{"a VWheel direction", func(s *Snapshot) { s.Wheels[0].Dir = 0 }, "direction"},
+		{"a nested wheel direction", func(s *Snapshot) { s.Nested[0].Dir = 2 }, "direction"},
+		{"the CWheel direction", func(s *Snapshot) { s.CWheel.Dir = 3 }, "direction"},
+		{"an entered path", func(s *Snapshot) { s.Wheels[0].Entered = []int{-1} }, "entered"},
+	} {
+		s, err := ParseSnapshot(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.edit(s)
+		if err := NewVM(nil).Restore(s); err == nil || !strings.Contains(err.Error(), tc.error) {
+			t.Errorf("restoring with a bad %s returned %v, want an error about %q", tc.name, err, tc.error)
+		}
+	}
+
+	// the formats before named wheels, generators, nesting and maps only lack fields, so they still load
+	s, _ = ParseSnapshot(data)
+	s.Version = 1
+	s.Nested = nil
+	s.Wheels[0].Data = s.Wheels[0].Data[:0]
+	s.Wheels[0].Entered = nil
+	if err := NewVM(nil).Restore(s); err != nil {
+		t.Errorf("restoring a version 1 snapshot: %v", err)
+	}
+}
+
+func TestRestoreGeneratorsBeforeIDs(t *testing.T) {
+	// the second generator is left part way through
+	vm, _ := loadSource(t, "DEF \"one\" 0\nNEWV 7\nYIELD\nRET\nGEN \"one\"\nRESUME\nRESUME\nGEN \"one\"\n")
+	for vm.Step() {
+	}
+	s, err := vm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// version 5 kept the finished generator in the list, and the second one's id was its place after it
+	s.Version = 5
+	s.Generators[0].ID = 0
+	s.Generators = append([]snapshotGenerator{{Done: true}}, s.Generators...)
+	s.LastGen = 0
+	restored := NewVM(nil)
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.generators) != 1 || restored.generators[2] == nil || restored.lastGenerator != 2 {
+		t.Errorf("restored generators %v up to id %d, want only generator 2", restored.generators, restored.lastGenerator)
+	}
+}
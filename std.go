@@ -0,0 +1,25 @@
+package twist
+
+import (
+	"embed"
+	"strings"
+)
+
+// The standard library is bundled into the binary, so IMPORT "std/math" works from
+// any directory and in the playground, which has no files to import from
+//
+//go:embed std/*.whl
+var stdlib embed.FS
+
+// stdModule returns the source of a bundled module, name is an import path like "std/math" or "std/math.whl"
+func stdModule(name string) (path, source string, ok bool) {
+	if !strings.HasPrefix(name, "std/") {
+		return "", "", false
+	}
+	path = strings.TrimSuffix(name, ".whl") + ".whl"
+	data, err := stdlib.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+	return path, string(data), true
+}
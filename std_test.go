@@ -0,0 +1,126 @@
+package twist
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// callStd runs a program that passes args to a standard library function and returns
+// what it left on the argument stack
+func callStd(t *testing.T, module, fn string, args ...interface{}) (result []Value) {
+	t.Helper()
+	var source strings.Builder
+	fmt.Fprintf(&source, "IMPORT \"std/%s\"\n", module)
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			fmt.Fprintf(&source, "NEWV %q\n", s)
+		} else {
+			fmt.Fprintf(&source, "NEWV %d\n", arg)
+		}
+		if i > 0 {
+			source.WriteString("MOVVW 1\n")
+		}
+		source.WriteString("ADDARG\n")
+	}
+	fmt.Fprintf(&source, "CALL \"%s.%s\" %d\nDEL 0\nRET\n", module, fn, len(args))
+
+	instructions, err := NewLoader().LoadSource("", source.String())
+	if err != nil {
+		t.Fatalf("%s.%s: %v", module, fn, err)
+	}
+	vm := NewVM(instructions)
+	var out bytes.Buffer
+	vm.stdout = &out
+	vm.stderr = &out
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s.%s%v: %v %s", module, fn, args, r, out.String())
+		}
+	}()
+	vm.Run()
+	return vm.args
+}
+
+func TestStdLibrary(t *testing.T) {
+	tests := []struct {
+		module, fn string
+		args       []interface{}
+		want       interface{}
+	}{
+		{"math", "max", []interface{}{3, 9}, 9},
+		{"math", "max", []interface{}{9, 3}, 9},
+		{"math", "max", []interface{}{-4, -4}, -4},
+		{"math", "min", []interface{}{3, 9}, 3},
+		{"math", "min", []interface{}{9, 3}, 3},
+		{"math", "min", []interface{}{-2, -7}, -7},
+		{"math", "abs", []interface{}{-12}, 12},
+		{"math", "abs", []interface{}{12}, 12},
+		{"math", "abs", []interface{}{0}, 0},
+		{"math", "clamp", []interface{}{15, 0, 10}, 10},
+		{"math", "clamp", []interface{}{-5, 0, 10}, 0},
+		{"math", "clamp", []interface{}{4, 0, 10}, 4},
+		{"math", "pow", []interface{}{2, 10}, 1024},
+		{"math", "pow", []interface{}{-3, 3}, -27},
+		{"math", "pow", []interface{}{7, 0}, 1},
+
+		{"str", "len", []interface{}{"wheel"}, 5},
+		{"str", "len", []interface{}{1234}, 4},
+		{"str", "concat", []interface{}{"rota", "wheel"}, "rotawheel"},
+		{"str", "concat", []interface{}{"line ", 7}, "line 7"},
+		{"str", "repeat", []interface{}{"ab", 3}, "ababab"},
+		{"str", "repeat", []interface{}{"ab", 0}, ""},
+		{"str", "pad_left", []interface{}{42, 5, "0"}, "00042"},
+		{"str", "pad_left", []interface{}{"long", 2, " "}, "long"},
+		{"str", "pad_right", []interface{}{"id", 4, "."}, "id.."},
+		{"str", "pad_right", []interface{}{7, 3, "-"}, "7--"},
+
+		{"wheel", "sum", []interface{}{1, 2, 3, 4}, 10},
+		{"wheel", "product", []interface{}{2, 3, 4}, 24},
+		{"wheel", "count", []interface{}{5, "x", 7}, 3},
+		{"wheel", "count", []interface{}{}, 0},
+		{"wheel", "max", []interface{}{4, 11, -2, 8, 11, 3}, 11},
+		{"wheel", "max", []interface{}{6}, 6},
+		{"wheel", "min", []interface{}{4, 11, -2, 8, 3}, -2},
+		{"wheel", "min", []interface{}{9, 1}, 1},
+	}
+	for _, test := range tests {
+		got := callStd(t, test.module, test.fn, test.args...)
+		if want, _ := toValues([]interface{}{test.want}); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s.%s%v = %v, want %v", test.module, test.fn, test.args, got, want)
+		}
+	}
+}
+
+func TestStdMissingModule(t *testing.T) {
+	_, err := NewLoader().LoadSource("", "IMPORT \"std/nope\"\n")
+	if err == nil || !strings.Contains(err.Error(), "standard library") {
+		t.Fatalf("got %v, want an error about the standard library", err)
+	}
+}
+
+func TestCallCopiesItsArguments(t *testing.T) {
+	// "f" queues an argument and then grows its VWheel, like a std function returning with ADDARG.
+	// The queued value must stay what was passed
+	out := runModules(t, map[string]string{"main.whl": `DEF "f" 3
+ADDARG
+NEWV 9
+RET
+DEF "show" 1
+OUT
+RET
+NEWV 1
+ADDARG
+ADDARG
+ADDARG
+CALL "f" 3
+OUT "skipped"
+CALL "show" 1
+OUT "skipped"
+`})
+	if want := "1 \n"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,244 @@
+package twist
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SPAWN runs a function on a thread of its own, a goroutine with its own CWheel cursor, call stack,
+// VWheels and argument stack. The program, the functions and the named wheels are shared.
+// Threads pass values through gears, channels with a name: SEND waits until a RECV on the same gear
+// takes the value and RECV waits until there's one to take. JOIN waits for a thread to RET and
+// moves whatever it left on its argument stack over, like a CALL returning.
+// Only one thread runs an instruction at a time, Step holds the group's lock, and an instruction that
+// has to wait returns Blocked so the thread sleeps until another one changes something.
+// With a Scheduler (scheduler.go) the threads aren't goroutines, Run steps them all in turn instead
+
+// threadGroup is what the threads of a program share
+type threadGroup struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	// threads holds every thread ever spawned, the index is its id and 0 is the program itself
+	threads []*VM
+	gears   map[string][]*parcel
+	// scheduler picks which thread runs next, nil runs every thread on a goroutine of its own
+	scheduler *Scheduler
+	// done is set once the program has ended, spawned threads stop before their next instruction.
+	// err is the error a spawned thread died with, the program panics with it
+	done bool
+	err  error
+}
+
+// parcel is a value on its way through a gear, taken is set by the RECV that got it
+type parcel struct {
+	gear  string
+	value Value
+	taken bool
+}
+
+func newThreadGroup(main *VM) *threadGroup {
+	g := &threadGroup{threads: []*VM{main}, gears: make(map[string][]*parcel)}
+	g.changed = sync.NewCond(&g.mu)
+	return g
+}
+
+// wake tells every waiting thread to try its instruction again
+func (g *threadGroup) wake() {
+	for _, t := range g.threads {
+		t.waiting = false
+	}
+	g.changed.Broadcast()
+}
+
+// deadlocked reports whether every thread still running is waiting, nothing can wake them then
+func (g *threadGroup) deadlocked() bool {
+	for _, t := range g.threads {
+		if !t.finished && !t.waiting {
+			return false
+		}
+	}
+	return true
+}
+
+// end stops the spawned threads, the program is over
+func (g *threadGroup) end() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.done = true
+	g.wake()
+}
+
+// spawned reports whether the program has started any threads
+func (g *threadGroup) spawned() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.threads) > 1
+}
+
+// interrupted checks on the rest of the group before an instruction: the program panics with the error
+// of a thread that died, and spawned threads stop once the program has ended
+func (vm *VM) interrupted() bool {
+	g := vm.group
+	if vm.id == 0 && g.err != nil {
+		err := g.err
+		g.err = nil
+		panic(err)
+	}
+	return vm.id != 0 && g.done
+}
+
+// wait sleeps until another thread changes something. If every thread is waiting nothing ever will,
+// so it throws a deadlock instead, returning false if an ERRH handled it.
+// With a Scheduler it doesn't sleep, the thread just isn't picked again until it's woken
+func (vm *VM) wait(inst *Instruction) bool {
+	g := vm.group
+	vm.waiting = true
+	if g.deadlocked() {
+		vm.waiting = false
+		vm.cancelSend()
+		vm.throwError(fmt.Sprintf("%s: every thread is waiting", DEADLOCK_ERROR), inst)
+		return false
+	}
+	if g.scheduler == nil {
+		g.changed.Wait()
+	}
+	return true
+}
+
+// unlocked runs fn without holding the group's lock, so a thread sleeping in DEL or reading for INP
+// doesn't hold up the others
+func (vm *VM) unlocked(fn func()) {
+	vm.group.mu.Unlock()
+	defer vm.group.mu.Lock()
+	fn()
+}
+
+// spawn starts a thread running the function at start with args on its VWheel
+func (vm *VM) spawn(start int, args []Value) *VM {
+	g := vm.group
+	t := &VM{
+		C:          CWheel{cursor: start, data: vm.C.data, code: vm.C.code, dir: vm.C.dir},
+		dataStack:  []VWheel{{dir: 1, data: append([]Value(nil), args...)}},
+		functions:  vm.functions,
+		hosts:      vm.hosts,
+		named:      vm.named,
+		programEnd: vm.programEnd,
+		stdin:      vm.stdin,
+		stdout:     vm.stdout,
+		stderr:     vm.stderr,
+		session:    vm.session,
+		clock:      vm.clock,
+		profiler:   vm.profiler,
+		coverage:   vm.coverage,
+		group:      g,
+		id:         len(g.threads),
+	}
+	g.threads = append(g.threads, t)
+	if g.scheduler == nil {
+		go t.runThread()
+	}
+	return t
+}
+
+// runThread steps a spawned thread until its function returns, an unhandled error ends the whole program
+func (vm *VM) runThread() {
+	defer func() {
+		r := recover()
+		g := vm.group
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if r != nil && g.err == nil && !g.done {
+			if err, ok := r.(error); ok {
+				g.err = err
+			} else {
+				g.err = fmt.Errorf("%v", r)
+			}
+		}
+		vm.finished = true
+		g.wake()
+	}()
+	for vm.Step() {
+	}
+}
+
+// cancelSend takes back a value no RECV got to
+func (vm *VM) cancelSend() {
+	if vm.outbox == nil {
+		return
+	}
+	g := vm.group
+	queue := g.gears[vm.outbox.gear]
+	for i, p := range queue {
+		if p == vm.outbox {
+			g.gears[vm.outbox.gear] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	vm.outbox = nil
+}
+
+func (vm *VM) opSPAWN(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	fn, found := vm.lookupFunction(inst.ArgumentStr, inst)
+	if !found {
+		vm.throwError(fmt.Sprintf("%s '%s'", UNDEFINED_FUNCTION_ERROR, inst.ArgumentStr), inst)
+		return Next
+	}
+	popped_args, ok := vm.callArgs(fn, inst)
+	if !ok {
+		return Next
+	}
+	thread := vm.spawn(fn.line, popped_args)
+	currentVWheel.data = append(currentVWheel.data, IntValue(thread.id))
+	return Next
+}
+
+func (vm *VM) opSEND(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	// Step runs SEND again after every wake up, the second time round the value is already in the gear
+	if vm.outbox != nil {
+		if !vm.outbox.taken {
+			return Blocked
+		}
+		vm.outbox = nil
+		return Next
+	}
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	vm.outbox = &parcel{gear: inst.ArgumentStr, value: currentVWheel.data[currentVWheel.cursor]}
+	vm.group.gears[inst.ArgumentStr] = append(vm.group.gears[inst.ArgumentStr], vm.outbox)
+	vm.group.wake()
+	return Blocked
+}
+
+func (vm *VM) opRECV(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	queue := vm.group.gears[inst.ArgumentStr]
+	if len(queue) == 0 {
+		return Blocked
+	}
+	p := queue[0]
+	vm.group.gears[inst.ArgumentStr] = queue[1:]
+	p.taken = true
+	vm.group.wake()
+	currentVWheel.data = append(currentVWheel.data, p.value)
+	return Next
+}
+
+func (vm *VM) opJOIN(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	id, ok := currentVWheel.data[currentVWheel.cursor].Int()
+	if !ok || id <= 0 || id >= len(vm.group.threads) || id == vm.id {
+		vm.throwError(fmt.Sprintf("%s: no thread %v to join", BAD_ARGUMENT_ERROR, currentVWheel.data[currentVWheel.cursor]), inst)
+		return Next
+	}
+	thread := vm.group.threads[id]
+	if !thread.finished {
+		return Blocked
+	}
+	vm.args = append(vm.args, thread.args...)
+	thread.args = nil
+	return Next
+}
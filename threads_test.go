@@ -0,0 +1,116 @@
+package twist
+
+import "testing"
+
+// runScheduled runs source with s picking the threads, nil runs them on goroutines
+func runScheduled(t *testing.T, source string, s *Scheduler) string {
+	t.Helper()
+	vm, out := loadSource(t, source)
+	vm.Schedule(s)
+	vm.Run()
+	return out.String()
+}
+
+func TestSeededScheduleRepeats(t *testing.T) {
+	const source = `DEF "a" 0
+OUT "a1"
+OUT "a2"
+OUT "a3"
+OUT "a4"
+RET
+DEF "b" 0
+OUT "b1"
+OUT "b2"
+OUT "b3"
+OUT "b4"
+RET
+SPAWN "a"
+SPAWN "b"
+JOIN
+MOVVW 1
+JOIN
+OUT "done"
+`
+	traces := make(map[string]bool)
+	for seed := int64(1); seed <= 5; seed++ {
+		first := runScheduled(t, source, NewSeededScheduler(seed))
+		if second := runScheduled(t, source, NewSeededScheduler(seed)); first != second {
+			t.Errorf("random:%d ran\n%s\nand then\n%s", seed, first, second)
+		}
+		traces[first] = true
+	}
+	// otherwise the threads didn't interleave and there was nothing to repeat
+	if len(traces) < 2 {
+		t.Errorf("five seeds all ran the threads in the same order")
+	}
+}
+
+func TestThreadsPassValuesThroughGears(t *testing.T) {
+	const source = `DEF "next" 1
+ADD 1
+SEND "out"
+ADDARG
+RET
+NEWV 41
+ADDARG
+SPAWN "next" 1
+RECV "out"
+MOVVW 2
+OUT
+MOVVW -1
+JOIN
+POPARG
+MOVVW 2
+OUT
+`
+	for _, s := range []*Scheduler{nil, NewRoundRobinScheduler(), NewSeededScheduler(1)} {
+		if got, want := runScheduled(t, source, s), "42 \n42 \n"; got != want {
+			t.Errorf("schedule %v: output %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestDeadlockIsThrown(t *testing.T) {
+	const alone = `RECV "nothing"
+ERRH "DEADLOCK_ERROR" -2
+OUT "received"
+OUT "deadlock"
+`
+	if got, want := runScheduled(t, alone, nil), "deadlock\n"; got != want {
+		t.Errorf("RECV with no other thread printed %q, want %q", got, want)
+	}
+
+	// the thread waits first, so the program's JOIN is the wait that finds everyone waiting
+	const joined = `DEF "listen" 0
+RECV "nothing"
+RET
+SPAWN "listen"
+JOIN
+ERRH "DEADLOCK_ERROR" -2
+OUT "joined"
+OUT "deadlock"
+`
+	if got, want := runScheduled(t, joined, NewRoundRobinScheduler()), "deadlock\n"; got != want {
+		t.Errorf("JOIN on a thread waiting on RECV printed %q, want %q", got, want)
+	}
+}
+
+func TestThreadSharesGlobalVWheel(t *testing.T) {
+	// the program's cursor stays on the counter, RECV waits for the thread without moving it
+	const source = `NEWV 0
+DEF "bump" 0
+LOADG
+ADD 1
+STOREG
+SEND "done"
+RET
+SPAWN "bump"
+RECV "done"
+OUT
+`
+	for _, s := range []*Scheduler{nil, NewRoundRobinScheduler()} {
+		if got, want := runScheduled(t, source, s), "1 \n"; got != want {
+			t.Errorf("schedule %v: output %q, want %q", s, got, want)
+		}
+	}
+}
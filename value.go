@@ -0,0 +1,323 @@
+package twist
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Value is anything a VWheel cell or the argument stack can hold. The kind says which of the fields is in use,
+// so a cell never has to be type asserted, and an int is stored in place rather than boxed on the heap.
+// A float keeps its bits in bits rather than n, which is only 32 bits wide on some targets. The zero Value is the int 0
+type Value struct {
+	kind Kind
+	n    int
+	bits uint64
+	s    string
+	// p is what a wheel or map cell holds. Copying the Value shares it, it isn't copied
+	p *shared
+}
+
+// shared is the wheel of a KindWheel cell or the map of a KindMap cell, behind one pointer
+// so the kinds that don't use it pay for a single nil field
+type shared struct {
+	wheel   VWheel
+	entries valueMap
+}
+
+// valueMap is what a map cell holds. Keys are ints, floats or strings, 2 and 2.0 are different keys
+type valueMap map[Value]Value
+
+// Kind is the type of a Value
+type Kind uint8
+
+const (
+	KindInt Kind = iota
+	KindFloat
+	KindString
+	KindWheel
+	KindMap
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "int"
+	case KindFloat:
+		return "float"
+	case KindString:
+		return "string"
+	case KindWheel:
+		return "wheel"
+	case KindMap:
+		return "map"
+	}
+	return fmt.Sprintf("kind %d", k)
+}
+
+func IntValue(n int) Value {
+	return Value{kind: KindInt, n: n}
+}
+
+func FloatValue(f float64) Value {
+	return Value{kind: KindFloat, bits: math.Float64bits(f)}
+}
+
+func StringValue(s string) Value {
+	return Value{kind: KindString, s: s}
+}
+
+// WheelValue is a new wheel holding values, with its cursor on the first one
+func WheelValue(values ...Value) Value {
+	return Value{kind: KindWheel, p: &shared{wheel: VWheel{dir: 1, data: append([]Value(nil), values...)}}}
+}
+
+// MapValue is a new map holding a copy of entries
+func MapValue(entries map[Value]Value) Value {
+	m := make(valueMap, len(entries))
+	for k, v := range entries {
+		m[k] = v
+	}
+	return Value{kind: KindMap, p: &shared{entries: m}}
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// Int returns the value of an int, ok is false for any other kind
+func (v Value) Int() (n int, ok bool) {
+	return v.n, v.kind == KindInt
+}
+
+// Float returns a number as a float64, ok is false for a string
+func (v Value) Float() (f float64, ok bool) {
+	switch v.kind {
+	case KindInt:
+		return float64(v.n), true
+	case KindFloat:
+		return v.float(), true
+	}
+	return 0, false
+}
+
+func (v Value) float() float64 {
+	return math.Float64frombits(v.bits)
+}
+
+// Str returns the value of a string, ok is false for any other kind
+func (v Value) Str() (s string, ok bool) {
+	return v.s, v.kind == KindString
+}
+
+// Items returns the cells of a wheel, ok is false for any other kind.
+// The slice is the wheel's own, a host function changing it changes the wheel
+func (v Value) Items() (items []Value, ok bool) {
+	if v.kind != KindWheel {
+		return nil, false
+	}
+	return v.p.wheel.data, true
+}
+
+// Entries returns the entries of a map, ok is false for any other kind.
+// The map is the cell's own, a host function changing it changes the cell
+func (v Value) Entries() (entries map[Value]Value, ok bool) {
+	if v.kind != KindMap {
+		return nil, false
+	}
+	return v.p.entries, true
+}
+
+// IsKey reports whether v can be a map key
+func (v Value) IsKey() bool {
+	return v.kind == KindInt || v.kind == KindFloat || v.kind == KindString
+}
+
+// sortedKeys lists the keys of a map numbers first, smallest to biggest, then strings in order
+func sortedKeys(m valueMap) []Value {
+	keys := make([]Value, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b Value) int {
+		if a.IsNumber() != b.IsNumber() {
+			if a.IsNumber() {
+				return -1
+			}
+			return 1
+		}
+		if a.IsNumber() {
+			x, _ := a.Float()
+			y, _ := b.Float()
+			if c := cmp.Compare(x, y); c != 0 {
+				return c
+			}
+			// 2 before 2.0
+			return cmp.Compare(a.kind, b.kind)
+		}
+		return strings.Compare(a.s, b.s)
+	})
+	return keys
+}
+
+// IsNumber reports whether v is an int or a float
+func (v Value) IsNumber() bool {
+	return v.kind == KindInt || v.kind == KindFloat
+}
+
+// IsZero reports whether v is the number 0, what DIV can't divide by
+func (v Value) IsZero() bool {
+	f, ok := v.Float()
+	return ok && f == 0
+}
+
+// String formats v the way OUT prints it, a wheel as its cells in braces like {1 2 {3}}
+// and a map as its entries in brackets like (a:1 b:{2})
+func (v Value) String() string {
+	switch v.kind {
+	case KindInt:
+		return strconv.Itoa(v.n)
+	case KindFloat:
+		return strconv.FormatFloat(v.float(), 'g', -1, 64)
+	case KindString:
+		return v.s
+	case KindWheel, KindMap:
+		var b strings.Builder
+		v.write(&b, nil)
+		return b.String()
+	}
+	return fmt.Sprintf("<%s>", v.kind)
+}
+
+// appendTo appends v the way String formats it, without allocating for a number or a string
+func (v Value) appendTo(b []byte) []byte {
+	switch v.kind {
+	case KindInt:
+		return strconv.AppendInt(b, int64(v.n), 10)
+	case KindFloat:
+		return strconv.AppendFloat(b, v.float(), 'g', -1, 64)
+	case KindString:
+		return append(b, v.s...)
+	}
+	return append(b, v.String()...)
+}
+
+// write formats v, open is the wheels and maps it is inside of so one that holds itself prints {...} or (...)
+func (v Value) write(b *strings.Builder, open []*shared) {
+	if v.kind != KindWheel && v.kind != KindMap {
+		b.WriteString(v.String())
+		return
+	}
+	if slices.Contains(open, v.p) {
+		if v.kind == KindWheel {
+			b.WriteString("{...}")
+		} else {
+			b.WriteString("(...)")
+		}
+		return
+	}
+	open = append(open, v.p)
+	if v.kind == KindWheel {
+		b.WriteByte('{')
+		for i, item := range v.p.wheel.data {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			item.write(b, open)
+		}
+		b.WriteByte('}')
+		return
+	}
+	b.WriteByte('(')
+	for i, key := range sortedKeys(v.p.entries) {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key.String())
+		b.WriteByte(':')
+		v.p.entries[key].write(b, open)
+	}
+	b.WriteByte(')')
+}
+
+// Interface is v as a plain Go int, float64 or string, a []interface{} of a wheel's cells or a
+// map[interface{}]interface{} of a map's entries. A wheel or map inside itself comes out as nil
+func (v Value) Interface() interface{} {
+	return v.plain(nil)
+}
+
+func (v Value) plain(open []*shared) interface{} {
+	switch v.kind {
+	case KindFloat:
+		return v.float()
+	case KindString:
+		return v.s
+	case KindWheel, KindMap:
+		if slices.Contains(open, v.p) {
+			return nil
+		}
+		open = append(open, v.p)
+		if v.kind == KindMap {
+			entries := make(map[interface{}]interface{}, len(v.p.entries))
+			for k, item := range v.p.entries {
+				entries[k.plain(open)] = item.plain(open)
+			}
+			return entries
+		}
+		items := make([]interface{}, len(v.p.wheel.data))
+		for i, item := range v.p.wheel.data {
+			items[i] = item.plain(open)
+		}
+		return items
+	}
+	return v.n
+}
+
+// Equal reports whether v and o are the same kind with the same value, for wheels and maps the very same one
+func (v Value) Equal(o Value) bool {
+	return v == o
+}
+
+// arith applies an operator to two numbers: two ints give an int, a float on either side gives a float.
+// ok is false if either of them isn't a number
+func arith(a, b Value, ints func(x, y int) int, floats func(x, y float64) float64) (Value, bool) {
+	if a.kind == KindInt && b.kind == KindInt {
+		return IntValue(ints(a.n, b.n)), true
+	}
+	x, okA := a.Float()
+	y, okB := b.Float()
+	if !okA || !okB {
+		return Value{}, false
+	}
+	return FloatValue(floats(x, y)), true
+}
+
+func (v Value) Add(o Value) (Value, bool) {
+	return arith(v, o, func(x, y int) int { return x + y }, func(x, y float64) float64 { return x + y })
+}
+
+func (v Value) Sub(o Value) (Value, bool) {
+	return arith(v, o, func(x, y int) int { return x - y }, func(x, y float64) float64 { return x - y })
+}
+
+func (v Value) Mul(o Value) (Value, bool) {
+	return arith(v, o, func(x, y int) int { return x * y }, func(x, y float64) float64 { return x * y })
+}
+
+// Div divides, whole for two ints. The caller checks o.IsZero first
+func (v Value) Div(o Value) (Value, bool) {
+	return arith(v, o, func(x, y int) int { return x / y }, func(x, y float64) float64 { return x / y })
+}
+
+// Greater reports whether v is a bigger number than o, ok is false if either of them isn't a number
+func (v Value) Greater(o Value) (greater bool, ok bool) {
+	if v.kind == KindInt && o.kind == KindInt {
+		return v.n > o.n, true
+	}
+	x, okV := v.Float()
+	y, okO := o.Float()
+	return x > y, okV && okO
+}
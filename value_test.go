@@ -0,0 +1,33 @@
+package twist
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFloatValues(t *testing.T) {
+	// every one of these needs the high 32 bits of its float64, which an int doesn't have on 386
+	for _, f := range []float64{1.5, -2.25, 0.1, 1e300, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(-1)} {
+		v := FloatValue(f)
+		if got, ok := v.Float(); !ok || got != f {
+			t.Errorf("FloatValue(%v).Float() = %v, %v", f, got, ok)
+		}
+		if !v.Equal(FloatValue(f)) {
+			t.Errorf("FloatValue(%v) isn't equal to itself", f)
+		}
+	}
+
+	if got := FloatValue(1.5).String(); got != "1.5" {
+		t.Errorf("1.5 prints as %q", got)
+	}
+	if sum, ok := FloatValue(1.5).Add(IntValue(2)); !ok || !sum.Equal(FloatValue(3.5)) {
+		t.Errorf("1.5 + 2 = %v, want 3.5", sum)
+	}
+	if greater, ok := FloatValue(0.5).Greater(FloatValue(0.25)); !ok || !greater {
+		t.Errorf("0.5 isn't greater than 0.25")
+	}
+	// 2 and 2.0 are different map keys
+	if FloatValue(2).Equal(IntValue(2)) {
+		t.Errorf("the float 2 is equal to the int 2")
+	}
+}
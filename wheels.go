@@ -0,0 +1,94 @@
+package twist
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Named wheels are global VWheels that live alongside the dataStack, so functions can share
+// buffers without passing everything through ADDARG. WHEEL "name" creates one, USE "name" makes it
+// the wheel instructions work on (USE alone goes back to the frame's own), and PUT/GET copy the
+// value under the cursor between the active wheel and a named one.
+// USE also leaves any wheel ENTERed inside the one it switches away from.
+// Which wheel is active belongs to the frame, a CALL starts on its own wheel and RET goes back to the caller's choice
+
+// wheel is the VWheel instructions work on: the named wheel the current frame selected, or the frame itself,
+// and then whichever wheel inside it the frame ENTERed
+func (vm *VM) wheel() *VWheel {
+	frame := &vm.dataStack[len(vm.dataStack)-1]
+	wheel := frame
+	if frame.active != "" {
+		if named, found := vm.named[frame.active]; found {
+			wheel = named
+		}
+	}
+	if len(frame.entered) > 0 {
+		return enteredWheel(wheel, frame.entered)
+	}
+	return wheel
+}
+
+// namedWheel finds a wheel created by WHEEL, throwing BAD_ARGUMENT_ERROR if there isn't one
+func (vm *VM) namedWheel(inst *Instruction) *VWheel {
+	named, found := vm.named[inst.ArgumentStr]
+	if !found {
+		vm.throwError(fmt.Sprintf("%s: no wheel named '%s'", BAD_ARGUMENT_ERROR, inst.ArgumentStr), inst)
+	}
+	return named
+}
+
+func (vm *VM) opWHEEL(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if vm.named == nil {
+		vm.named = make(map[string]*VWheel)
+	}
+	if _, exists := vm.named[inst.ArgumentStr]; !exists {
+		vm.named[inst.ArgumentStr] = &VWheel{dir: 1}
+	}
+	return Next
+}
+
+func (vm *VM) opUSE(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	if len(inst.ArgumentStr) > 0 && vm.namedWheel(inst) == nil {
+		return Next
+	}
+	frame := &vm.dataStack[len(vm.dataStack)-1]
+	frame.active = inst.ArgumentStr
+	frame.entered = nil
+	return Next
+}
+
+func (vm *VM) opPUT(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	named := vm.namedWheel(inst)
+	if named == nil {
+		return Next
+	}
+	if len(currentVWheel.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	named.data = append(named.data, currentVWheel.data[currentVWheel.cursor])
+	return Next
+}
+
+func (vm *VM) opGET(currentVWheel *VWheel, args *[]Value, inst *Instruction) Flow {
+	named := vm.namedWheel(inst)
+	if named == nil {
+		return Next
+	}
+	if len(named.data) == 0 {
+		vm.throwError(EMPTY_VWHEEL_ERROR, inst)
+		return Next
+	}
+	currentVWheel.data = append(currentVWheel.data, named.data[named.cursor])
+	return Next
+}
+
+// wheelNames lists the named wheels in a stable order
+func (vm *VM) wheelNames() []string {
+	names := make([]string, 0, len(vm.named))
+	for name := range vm.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,44 @@
+package twist
+
+import "testing"
+
+func TestNamedWheels(t *testing.T) {
+	const source = `WHEEL "log"
+DEF "record" 1
+PUT "log"
+USE "log"
+RET
+NEWV 5
+ADDARG
+CALL "record" %
+OUT "skipped"
+OUT
+WHEEL "log"
+USE "log"
+OUT
+ADD 1
+USE
+OUT
+GET "log"
+MOVVW -1
+OUT
+PUT "nowhere"
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "put"
+OUT "handled"
+`
+	// the USE inside record ends with its RET, a second WHEEL keeps what the first made,
+	// and PUT and GET copy the cell rather than sharing it
+	if got, want := runSource(t, source), "5 \n5 \n5 \n6 \nhandled\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+
+	const unknown = `USE "nowhere"
+ERRH "BAD_ARGUMENT_ERROR" -2
+OUT "used"
+OUT "handled"
+`
+	if got, want := runSource(t, unknown), "handled\n"; got != want {
+		t.Errorf("USE of a wheel no WHEEL made printed %q, want %q", got, want)
+	}
+}